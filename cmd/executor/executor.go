@@ -5,9 +5,14 @@ import (
 	"log"
 	"os"
 	"os/signal"
+	"time"
 
 	"github.com/nokia/dynamic-local-pv-provisioner/pkg/handlers"
+	"github.com/nokia/dynamic-local-pv-provisioner/pkg/lease"
+	"github.com/nokia/dynamic-local-pv-provisioner/pkg/nodelabels"
+	"github.com/nokia/dynamic-local-pv-provisioner/pkg/preflight"
 	syscall "golang.org/x/sys/unix"
+	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/tools/cache"
 	"k8s.io/client-go/tools/clientcmd"
 )
@@ -18,8 +23,12 @@ const (
 )
 
 var (
-	kubeConfig  string
-	storagePath string
+	kubeConfig     string
+	storagePath    string
+	leaseNamespace string
+	leaseDuration  time.Duration
+	checkInterval  time.Duration
+	storageTier    string
 )
 
 type Executor struct {
@@ -31,24 +40,35 @@ func main() {
 	executor := Executor{
 		Controllers: make(map[string]cache.Controller),
 	}
+	nodeName := os.Getenv("NODE_NAME")
+	labeller := nodelabels.NewLabeller(nodeName, storageTier, preflight.Reflink(storagePath))
 	cfg, err := clientcmd.BuildConfigFromFlags("", kubeConfig)
 	if err != nil {
-		log.Fatal("ERROR: Parsing kubeconfig failed with error: " + err.Error() + ", exiting!")
+		fatal(labeller, "ERROR: Parsing kubeconfig failed with error: "+err.Error()+", exiting!")
 	}
 	pvcHandler, err := handlers.NewPvcHandler(storagePath, cfg)
 	if err != nil {
-		log.Fatal("ERROR: Could not initalize K8s client for PvcHandler because of error: " + err.Error() + ", exiting!")
+		fatal(labeller, "ERROR: Could not initalize K8s client for PvcHandler because of error: "+err.Error()+", exiting!")
 	}
 	pvcController := pvcHandler.CreateController()
 	executor.Controllers[PvcController] = pvcController
 
 	pvHandler, err := handlers.NewPvHandler(storagePath, cfg)
 	if err != nil {
-		log.Fatal("ERROR: Could not initalize K8s client for PvHandler because of error: " + err.Error() + ", exiting!")
+		fatal(labeller, "ERROR: Could not initalize K8s client for PvHandler because of error: "+err.Error()+", exiting!")
 	}
 	pvController := pvHandler.CreateController()
 	executor.Controllers[PvController] = pvController
 
+	kubeClient, err := kubernetes.NewForConfig(cfg)
+	if err != nil {
+		fatal(labeller, "ERROR: Could not initalize K8s client for the executor Lease because of error: "+err.Error()+", exiting!")
+	}
+	renewer, err := lease.NewRenewer(kubeClient, leaseNamespace, nodeName, leaseDuration, lease.Metadata{StoragePaths: []string{storagePath}})
+	if err != nil {
+		fatal(labeller, "ERROR: "+err.Error()+", exiting!")
+	}
+
 	stopChannel := make(chan struct{})
 	signalChannel := make(chan os.Signal, 1)
 	signal.Notify(signalChannel, syscall.SIGINT, syscall.SIGTERM)
@@ -56,16 +76,32 @@ func main() {
 	for _, controller := range executor.Controllers {
 		go controller.Run(stopChannel)
 	}
+	go renewer.Run(stopChannel)
+	checker := preflight.NewChecker(nodeName, storagePath)
+	// The node is labelled ready only while its storage passes the preflight checks
+	checker.OnResult = labeller.SetReady
+	go checker.Run(checkInterval, stopChannel)
 	// Wait until Controller pushes a signal on the stop channel
 	select {
 	case <-stopChannel:
-		log.Fatal("Storage controller stopped abruptly, exiting!")
+		fatal(labeller, "Storage controller stopped abruptly, exiting!")
 	case <-signalChannel:
 		log.Println("Orchestrator initiated graceful shutdown. See you soon!")
+		labeller.Remove()
 	}
 }
 
+// fatal removes the labels of the node before exiting, so no new volumes are placed onto it
+func fatal(labeller *nodelabels.Labeller, message string) {
+	labeller.Remove()
+	log.Fatal(message)
+}
+
 func init() {
 	flag.StringVar(&storagePath, "storagepath", "", "The path where VG is mounted and where sig-storage-controller is watching. Mandatory parameter.")
 	flag.StringVar(&kubeConfig, "kubeconfig", "", "Path to a kubeconfig. Optional parameter, only required if out-of-cluster.")
+	flag.StringVar(&leaseNamespace, "lease-namespace", lease.DefaultNamespace, "The namespace of the Lease the executor renews for its node.")
+	flag.DurationVar(&checkInterval, "preflight-check-interval", time.Minute, "How often the storage path is checked and the LocalStorageReady node condition is updated.")
+	flag.StringVar(&storageTier, "storage-tier", "", "The tier of the storage under --storagepath, like ssd or hdd, published in the "+nodelabels.TierLabel+" node label. Optional parameter.")
+	flag.DurationVar(&leaseDuration, "lease-duration", 40*time.Second, "The duration of the executor Lease, the webhook avoids the node when it is not renewed within.")
 }
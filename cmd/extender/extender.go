@@ -0,0 +1,56 @@
+package main
+
+import (
+	"flag"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/nokia/dynamic-local-pv-provisioner/pkg/extender"
+	"github.com/nokia/dynamic-local-pv-provisioner/pkg/lease"
+	"github.com/nokia/dynamic-local-pv-provisioner/pkg/nodeselector"
+	"k8s.io/client-go/tools/cache"
+)
+
+var nodeSelectMethod string
+
+func main() {
+	address := flag.String("address", ":8888", "address the scheduler extender listens on.")
+	nodeLabel := flag.String("node-label-for-dynamic", "", " node label selector for dynamic local pv provisoner, set-based expressions like \"disk in (ssd,nvme),!maintenance\" are accepted. Optional parameter, only required when local-storage not configured on all nodes.")
+	requireExecutorLease := flag.Bool("require-executor-lease", true, "select only the nodes whose executor renews its Lease in --executor-lease-namespace, like the webhook does.")
+	executorLeaseNamespace := flag.String("executor-lease-namespace", lease.DefaultNamespace, "namespace of the Leases renewed by the executors.")
+	flag.StringVar(&nodeSelectMethod, "node-selector-method", "round robin", "default node selector method, StorageClasses may override it with the "+nodeselector.StorageClassParameter+" parameter. Acceptable values: \""+strings.Join(nodeselector.Names(), "\", \"")+"\", default is \"round robin\"")
+	flag.Parse()
+	if _, err := nodeselector.Get(nodeSelectMethod); err != nil {
+		log.Fatalln("ERROR: " + err.Error())
+	}
+	ext, err := extender.NewExtender(nodeSelectMethod, *nodeLabel)
+	if err != nil {
+		log.Fatalln("ERROR: Scheduler extender could not be initialized, because: " + err.Error())
+	}
+	if *requireExecutorLease {
+		tracker, err := lease.NewTracker(*executorLeaseNamespace)
+		if err != nil {
+			log.Fatalln("ERROR: Executor Lease informer could not be initialized, because: " + err.Error())
+		}
+		stopCh := make(chan struct{})
+		go tracker.Run(stopCh)
+		// Every node would fail the check until the Leases are listed
+		if !cache.WaitForCacheSync(stopCh, tracker.HasSynced) {
+			log.Fatalln("ERROR: Executor Leases could not be listed")
+		}
+		ext.AddNodeCheck(tracker.ExecutorIsAlive)
+	}
+
+	http.HandleFunc("/filter", ext.ServeFilter)
+	http.HandleFunc("/prioritize", ext.ServePrioritize)
+	server := &http.Server{
+		Addr:         *address,
+		ReadTimeout:  5 * time.Second,
+		WriteTimeout: 5 * time.Second,
+	}
+	log.Println("INFO:DLPP scheduler extender is about to start listening on " + *address)
+	err = server.ListenAndServe()
+	log.Fatal(err)
+}
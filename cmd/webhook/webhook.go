@@ -1,14 +1,30 @@
 package main
 
 import (
+	"context"
 	"crypto/tls"
 	"flag"
+	"io/ioutil"
 	"log"
 	"net/http"
+	"os"
+	"os/signal"
+	"strings"
 	"time"
 
+	"github.com/nokia/dynamic-local-pv-provisioner/pkg/certs"
+	"github.com/nokia/dynamic-local-pv-provisioner/pkg/config"
+	"github.com/nokia/dynamic-local-pv-provisioner/pkg/health"
 	"github.com/nokia/dynamic-local-pv-provisioner/pkg/k8sclient"
+	"github.com/nokia/dynamic-local-pv-provisioner/pkg/lease"
 	"github.com/nokia/dynamic-local-pv-provisioner/pkg/mutator"
+	"github.com/nokia/dynamic-local-pv-provisioner/pkg/nodeselector"
+	"github.com/nokia/dynamic-local-pv-provisioner/pkg/registration"
+	"github.com/nokia/dynamic-local-pv-provisioner/pkg/rescheduler"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	syscall "golang.org/x/sys/unix"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/cache"
 )
 
 var nodeSelectMethod string
@@ -16,31 +32,252 @@ var nodeSelectMethod string
 func main() {
 	cert := flag.String("tls-cert-bundle", "", "file containing the x509 Certificate for HTTPS. (CA cert, if any, concatenated after server cert).")
 	key := flag.String("tls-private-key-file", "", "file containing the x509 private key matching --tls-cert-bundle.")
-	nodeLabel := flag.String("node-label-for-dynamic", "", " node label for dynamic local pv provisoner. Optional parameter, only required when local-storage not configured on all nodes.")
-	flag.StringVar(&nodeSelectMethod, "node-selector-method", "round robin", "node selector method. Acceptable values: \"round robin\" or \"capacity\", default is \"round robin\"")
+	nodeLabel := flag.String("node-label-for-dynamic", "", " node label selector for dynamic local pv provisoner, set-based expressions like \"disk in (ssd,nvme),!maintenance\" are accepted. Optional parameter, only required when local-storage not configured on all nodes.")
+	pinningNamespaces := flag.String("node-pinning-namespaces", "", "comma separated list of namespaces where users may set the nokia.k8s.io/nodeName annotation themselves. Elsewhere it requires RBAC permission to update persistentvolumeclaims/placement.")
+	healthAddress := flag.String("health-address", ":8080", "address serving the /healthz, /readyz and /metrics endpoints over plain HTTP.")
+	selfSignedCerts := flag.Bool("self-signed-certs", false, "generate a self-signed CA and serving certificate, store them in --cert-secret-name and patch the caBundle of --webhook-config-name. --tls-cert-bundle and --tls-private-key-file are ignored.")
+	certSecretName := flag.String("cert-secret-name", "dynamic-local-pv-webhook-certs", "name of the Secret storing the generated certificates.")
+	serviceName := flag.String("service-name", "dynamic-local-pv-provisoner-svc", "name of the Service in front of the webhook, the generated certificate is issued for it.")
+	servicePort := flag.Int("service-port", 443, "port of the Service in front of the webhook.")
+	namespace := flag.String("namespace", "kube-system", "namespace of the webhook Service and certificate Secret.")
+	webhookConfigName := flag.String("webhook-config-name", "dynamic-local-pv-provisoner-config", "name of the webhook configurations the generated caBundle is patched into.")
+	certReloadInterval := flag.Duration("cert-reload-interval", 10*time.Second, "how often --tls-cert-bundle and --tls-private-key-file are checked for rotated certificates.")
+	certSecretCheckInterval := flag.Duration("cert-secret-check-interval", time.Minute, "how often the Secret of --self-signed-certs is checked, so the certificate is renewed before it expires and the certificate regenerated by another replica is served.")
+	caBundleFile := flag.String("ca-bundle-file", "", "file containing the CA bundle registered in the webhook configurations, when the certificates are not self-signed. Optional parameter, the existing caBundle is kept when empty.")
+	registerWebhooks := flag.Bool("register-webhooks", false, "create or update the Mutating- and ValidatingWebhookConfiguration named --webhook-config-name at startup.")
+	registerValidating := flag.Bool("register-validating-webhook", true, "register the /validate-pvc webhook too, when --register-webhooks is set.")
+	deregisterOnShutdown := flag.Bool("deregister-on-shutdown", false, "delete the registered webhook configurations on graceful shutdown. Only safe with a single webhook replica.")
+	failurePolicy := flag.String("failure-policy", "Fail", "failure policy of the registered webhooks. Acceptable values: \"Fail\" or \"Ignore\".")
+	webhookTimeout := flag.Int("webhook-timeout", 30, "timeout of the registered webhooks in seconds, between 1 and 30.")
+	updateFailurePolicy := flag.String("update-failure-policy", "Fail", "failure policy of the registered webhook validating PVC updates, which guards the internal annotations. Every update of every PVC selected by --namespace-selector and --update-object-selector, outside --namespace, waits for it: with \"Fail\" no such PVC can be bound, resized or released while no webhook replica answers, with \"Ignore\" the internal annotations are unguarded meanwhile. Acceptable values: \"Fail\" or \"Ignore\".")
+	updateWebhookTimeout := flag.Int("update-webhook-timeout", 5, "timeout of the registered webhook validating PVC updates in seconds, between 1 and 30. It delays every PVC update while no webhook replica answers.")
+	namespaceSelector := flag.String("namespace-selector", "", "label selector of the namespaces the registered webhooks apply to. Empty selects every namespace.")
+	objectSelector := flag.String("object-selector", "", "label selector of the PVCs the registered webhooks apply to. Empty selects every PVC.")
+	updateObjectSelector := flag.String("update-object-selector", "", "label selector of the PVCs the registered webhook validating PVC updates applies to, like a label every local PVC carries, so the updates of other PVCs never wait for it. Empty uses --object-selector.")
+	requireExecutorLease := flag.Bool("require-executor-lease", true, "select only the nodes whose executor renews its Lease in --executor-lease-namespace.")
+	executorLeaseNamespace := flag.String("executor-lease-namespace", lease.DefaultNamespace, "namespace of the Leases renewed by the executors.")
+	dryRun := flag.Bool("dry-run", false, "compute the placement and the patches of every PVC, but admit it unchanged. What the webhooks would have done is logged and exported in the dlpp_webhook_dry_run_* metrics.")
+	rescheduleAfter := flag.Duration("reschedule-after", 0, "recreate the local PVCs which stay Pending longer than this on a node that failed to provision them, so they are placed again on another node. A PVC is recreated once no pod uses it any more, pods are never deleted. Optional parameter, PVCs are never rescheduled when 0.")
+	rescheduleConfigMap := flag.String("reschedule-config-map", "dynamic-local-pv-rescheduler", "name of the ConfigMap in --namespace the PVCs being rescheduled are saved in before they are deleted, with the nodes which failed them.")
+	topologyKey := flag.String("topology-spread-key", "", "node label, like topology.kubernetes.io/zone, the local PVCs are spread evenly over before the node selector method applies. StorageClasses may override it with the "+nodeselector.TopologyParameter+" parameter. Optional parameter, PVCs are not spread when empty.")
+	reservationTimeout := flag.Duration("reservation-timeout", 2*time.Minute, "how long the capacity of a placed claim stays reserved on its node, unless the claim is bound earlier.")
+	configMapName := flag.String("config-map-name", "", "name of the provisioner ConfigMap in --namespace, watched and reloaded on every change. Optional parameter, "+config.DefaultFilePath+" is read once when empty.")
+	flag.StringVar(&nodeSelectMethod, "node-selector-method", "round robin", "default node selector method, StorageClasses may override it with the "+nodeselector.StorageClassParameter+" parameter. Acceptable values: \""+strings.Join(nodeselector.Names(), "\", \"")+"\", default is \"round robin\"")
 	flag.Parse()
-	if nodeSelectMethod != k8sclient.RR && nodeSelectMethod != k8sclient.Cap {
-		log.Fatalln("ERROR: Unacceptable node-selector-method! Acceptable values: \"round robin\" or \"capacity\", default is \"round robin\"")
+	if _, err := nodeselector.Get(nodeSelectMethod); err != nil {
+		log.Fatalln("ERROR: " + err.Error())
 	}
-	mutate, err := mutator.NewMutator(nodeSelectMethod, *nodeLabel)
-	if cert == nil || key == nil {
-		log.Fatalln("ERROR: Configuring TLS is mandatory, --tls-cert-bundle and --tls-private-key-file cannot be empty!")
-		return
+	policy, err := registration.ParseFailurePolicy(*failurePolicy)
+	if err != nil {
+		log.Fatalln("ERROR: " + err.Error())
+	}
+	if *webhookTimeout < 1 || *webhookTimeout > 30 {
+		log.Fatalln("ERROR: Unacceptable webhook-timeout! It must be between 1 and 30 seconds")
+	}
+	updatePolicy, err := registration.ParseFailurePolicy(*updateFailurePolicy)
+	if err != nil {
+		log.Fatalln("ERROR: " + err.Error())
+	}
+	if *updateWebhookTimeout < 1 || *updateWebhookTimeout > 30 {
+		log.Fatalln("ERROR: Unacceptable update-webhook-timeout! It must be between 1 and 30 seconds")
+	}
+	registrationOptions := registration.Options{
+		ConfigName:           *webhookConfigName,
+		ServiceName:          *serviceName,
+		Namespace:            *namespace,
+		Port:                 int32(*servicePort),
+		FailurePolicy:        policy,
+		TimeoutSeconds:       int32(*webhookTimeout),
+		UpdateFailurePolicy:  updatePolicy,
+		UpdateTimeoutSeconds: int32(*updateWebhookTimeout),
+		Validating:           *registerValidating,
+	}
+	registrationOptions.NamespaceSelector, err = parseSelector(*namespaceSelector)
+	if err != nil {
+		log.Fatalln("ERROR: Unacceptable namespace-selector, because: " + err.Error())
+	}
+	registrationOptions.ObjectSelector, err = parseSelector(*objectSelector)
+	if err != nil {
+		log.Fatalln("ERROR: Unacceptable object-selector, because: " + err.Error())
+	}
+	registrationOptions.UpdateObjectSelector, err = parseSelector(*updateObjectSelector)
+	if err != nil {
+		log.Fatalln("ERROR: Unacceptable update-object-selector, because: " + err.Error())
+	}
+	namespaces := []string{}
+	if *pinningNamespaces != "" {
+		namespaces = strings.Split(*pinningNamespaces, ",")
+	}
+	configStore := config.NewStore(nil)
+	if *configMapName != "" {
+		watcher, err := config.NewWatcher(*namespace, *configMapName, configStore)
+		if err != nil {
+			log.Fatalln("ERROR: Configuration watcher could not be initialized, because: " + err.Error())
+		}
+		go watcher.Run(make(chan struct{}))
+		health.AddReadinessCheck("config", health.InformerSynced(watcher.HasSynced))
+	} else {
+		defaultConfig, err := config.LoadFile(config.DefaultFilePath)
+		if err != nil {
+			log.Println("WARNING: Cannot parse default node selector, because: " + err.Error() + ". Continue without it...")
+		}
+		configStore.Set(defaultConfig)
+	}
+	nodes, err := nodeselector.NewNodes()
+	if err != nil {
+		log.Fatalln("ERROR: Node informer could not be initialized, because: " + err.Error())
 	}
-	tlsConf, err := tls.LoadX509KeyPair(*cert, *key)
+	go nodes.Run(make(chan struct{}))
+	health.AddReadinessCheck("nodes", health.InformerSynced(nodes.HasSynced))
+	claims, err := nodeselector.NewClaims()
 	if err != nil {
-		log.Println("ERROR: TLS configuration could not be initialized, because:" + err.Error())
-		return
+		log.Fatalln("ERROR: Claim informer could not be initialized, because: " + err.Error())
 	}
+	reservations := nodeselector.NewReservations(claims, *reservationTimeout)
+	go claims.Run(make(chan struct{}))
+	health.AddReadinessCheck("claims", health.InformerSynced(claims.HasSynced))
+	volumes, err := nodeselector.NewVolumes()
+	if err != nil {
+		log.Fatalln("ERROR: Volume informer could not be initialized, because: " + err.Error())
+	}
+	go volumes.Run(make(chan struct{}))
+	health.AddReadinessCheck("volumes", health.InformerSynced(volumes.HasSynced))
+	mutate, err := mutator.NewMutator(nodeSelectMethod, *topologyKey, *nodeLabel, namespaces, configStore, nodes, claims, volumes, reservations)
+	if err != nil {
+		log.Fatalln("ERROR: Mutator could not be initialized, because: " + err.Error())
+	}
+	if *dryRun {
+		mutate.SetDryRun(nodeselector.NewShadowReservations(claims, *reservationTimeout))
+		log.Println("INFO: Webhook runs in dry-run mode, PVCs are admitted unchanged and never rescheduled")
+	}
+	if *rescheduleAfter > 0 && !*dryRun {
+		history, err := rescheduler.NewHistory(*namespace, *rescheduleConfigMap)
+		if err != nil {
+			log.Fatalln("ERROR: Rescheduling history informer could not be initialized, because: " + err.Error())
+		}
+		go history.Run(make(chan struct{}))
+		health.AddReadinessCheck("reschedule-history", health.InformerSynced(history.HasSynced))
+		mutate.SetHistory(history)
+		claimRescheduler, err := rescheduler.NewRescheduler(claims, nodes, history, *rescheduleAfter)
+		if err != nil {
+			log.Fatalln("ERROR: Rescheduler could not be initialized, because: " + err.Error())
+		}
+		identity, err := os.Hostname()
+		if err != nil {
+			log.Fatalln("ERROR: Cannot get hostname for leader election, because: " + err.Error())
+		}
+		err = k8sclient.RunLeaderElection(*namespace, "dynamic-local-pv-rescheduler", identity, func(stopCh <-chan struct{}) {
+			log.Println("INFO: " + identity + " is elected to reschedule the failed PVCs")
+			// A claim missing from an unsynced history would be rescheduled twice
+			if !cache.WaitForCacheSync(stopCh, history.HasSynced, claims.HasSynced) {
+				return
+			}
+			claimRescheduler.Run(30*time.Second, stopCh)
+		})
+		if err != nil {
+			log.Fatalln("ERROR: Rescheduler leader election could not be started, because: " + err.Error())
+		}
+	}
+	if *requireExecutorLease {
+		tracker, err := lease.NewTracker(*executorLeaseNamespace)
+		if err != nil {
+			log.Fatalln("ERROR: Executor Lease informer could not be initialized, because: " + err.Error())
+		}
+		go tracker.Run(make(chan struct{}))
+		health.AddReadinessCheck("executor-leases", health.InformerSynced(tracker.HasSynced))
+		mutate.AddNodeCheck(tracker.ExecutorIsAlive)
+	}
+	tlsConfig := &tls.Config{}
+	if *selfSignedCerts {
+		reloader, err := certs.NewSecretReloader(*certSecretName, *namespace, *serviceName)
+		if err != nil {
+			log.Fatalln("ERROR: TLS configuration could not be initialized, because: " + err.Error())
+		}
+		registrationOptions.CABundle = reloader.CABundle()
+		if !*registerWebhooks {
+			err = k8sclient.PatchWebhookCABundle(*webhookConfigName, registrationOptions.CABundle)
+			if err != nil {
+				log.Println("WARNING: Cannot patch caBundle of webhook configuration " + *webhookConfigName + ", because: " + err.Error())
+			}
+		}
+		reloader.OnCAChange = func(caBundle []byte) error {
+			if err := k8sclient.PatchWebhookCABundle(*webhookConfigName, caBundle); err != nil {
+				return err
+			}
+			log.Println("INFO: Renewed caBundle is patched into webhook configuration " + *webhookConfigName)
+			return nil
+		}
+		go reloader.Run(*certSecretCheckInterval, make(chan struct{}))
+		tlsConfig.GetCertificate = reloader.GetCertificate
+	} else {
+		if *cert == "" || *key == "" {
+			log.Fatalln("ERROR: Configuring TLS is mandatory, --tls-cert-bundle and --tls-private-key-file cannot be empty without --self-signed-certs!")
+		}
+		reloader, err := certs.NewReloader(*cert, *key)
+		if err != nil {
+			log.Fatalln("ERROR: TLS configuration could not be initialized, because: " + err.Error())
+		}
+		go reloader.Run(*certReloadInterval, make(chan struct{}))
+		tlsConfig.GetCertificate = reloader.GetCertificate
+		if *caBundleFile != "" {
+			registrationOptions.CABundle, err = ioutil.ReadFile(*caBundleFile)
+			if err != nil {
+				log.Fatalln("ERROR: Cannot read CA bundle, because: " + err.Error())
+			}
+		}
+	}
+	if *registerWebhooks {
+		if err = registration.Register(registrationOptions); err != nil {
+			log.Fatalln("ERROR: " + err.Error())
+		}
+		log.Println("INFO: Webhook configurations " + *webhookConfigName + " are registered")
+	}
+
+	health.AddReadinessCheck("apiserver", k8sclient.CheckConnectivity)
+	healthMux := http.NewServeMux()
+	healthMux.HandleFunc("/healthz", health.ServeHealthz)
+	healthMux.HandleFunc("/readyz", health.ServeReadyz)
+	healthMux.Handle("/metrics", promhttp.Handler())
+	go func() {
+		log.Println("INFO:DLPP webhook health and metrics endpoints are about to start listening on " + *healthAddress)
+		log.Fatal(http.ListenAndServe(*healthAddress, healthMux))
+	}()
 
-	http.HandleFunc("/mutating-pvc", mutate.ServeMutatePvc)
+	http.HandleFunc(registration.MutatingPath, mutate.ServeMutatePvc)
+	http.HandleFunc(registration.ValidatingPath, mutate.ServeValidatePvc)
 	server := &http.Server{
 		Addr:         ":443",
-		TLSConfig:    &tls.Config{Certificates: []tls.Certificate{tlsConf}},
+		TLSConfig:    tlsConfig,
 		ReadTimeout:  5 * time.Second,
 		WriteTimeout: 5 * time.Second,
 	}
-	log.Println("INFO:DLPP webhook is about to start listening on :443")
-	err = server.ListenAndServeTLS("", "")
-	log.Fatal(err)
+	go func() {
+		log.Println("INFO:DLPP webhook is about to start listening on :443")
+		err := server.ListenAndServeTLS("", "")
+		if err != http.ErrServerClosed {
+			log.Fatal(err)
+		}
+	}()
+
+	signalChannel := make(chan os.Signal, 1)
+	signal.Notify(signalChannel, syscall.SIGINT, syscall.SIGTERM)
+	<-signalChannel
+	log.Println("INFO: Orchestrator initiated graceful shutdown")
+	if *registerWebhooks && *deregisterOnShutdown {
+		if err = registration.Deregister(registrationOptions); err != nil {
+			log.Println("ERROR: " + err.Error())
+		}
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err = server.Shutdown(ctx); err != nil {
+		log.Println("ERROR: Webhook server could not be shut down gracefully, because: " + err.Error())
+	}
+}
+
+func parseSelector(selector string) (*metav1.LabelSelector, error) {
+	if selector == "" {
+		return nil, nil
+	}
+	return metav1.ParseToLabelSelector(selector)
 }
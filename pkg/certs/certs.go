@@ -0,0 +1,297 @@
+package certs
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"io/ioutil"
+	"log"
+	"math/big"
+	"sync"
+	"time"
+
+	"github.com/nokia/dynamic-local-pv-provisioner/pkg/k8sclient"
+	v1 "k8s.io/api/core/v1"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const (
+	CaCertKey      = "ca.crt"
+	validity       = 365 * 24 * time.Hour
+	renewThreshold = 30 * 24 * time.Hour
+)
+
+// Reloader serves the current certificate from disk, so rotated certificates are picked up without a restart
+type Reloader struct {
+	lock     sync.RWMutex
+	certFile string
+	keyFile  string
+	certPEM  []byte
+	keyPEM   []byte
+	cert     *tls.Certificate
+}
+
+func NewReloader(certFile string, keyFile string) (*Reloader, error) {
+	reloader := Reloader{certFile: certFile, keyFile: keyFile}
+	if _, err := reloader.reload(); err != nil {
+		return nil, err
+	}
+	return &reloader, nil
+}
+
+func (reloader *Reloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	reloader.lock.RLock()
+	defer reloader.lock.RUnlock()
+	return reloader.cert, nil
+}
+
+func (reloader *Reloader) Run(interval time.Duration, stopCh <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stopCh:
+			return
+		case <-ticker.C:
+			reloaded, err := reloader.reload()
+			if err != nil {
+				log.Println("ERROR: Cannot reload TLS certificate, keep serving the previous one, because: " + err.Error())
+			} else if reloaded {
+				log.Println("INFO: TLS certificate is reloaded from " + reloader.certFile)
+			}
+		}
+	}
+}
+
+func (reloader *Reloader) reload() (bool, error) {
+	certPEM, err := ioutil.ReadFile(reloader.certFile)
+	if err != nil {
+		return false, err
+	}
+	keyPEM, err := ioutil.ReadFile(reloader.keyFile)
+	if err != nil {
+		return false, err
+	}
+	reloader.lock.RLock()
+	unchanged := bytes.Equal(certPEM, reloader.certPEM) && bytes.Equal(keyPEM, reloader.keyPEM)
+	reloader.lock.RUnlock()
+	if unchanged {
+		return false, nil
+	}
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		return false, err
+	}
+	reloader.lock.Lock()
+	defer reloader.lock.Unlock()
+	reloader.certPEM = certPEM
+	reloader.keyPEM = keyPEM
+	reloader.cert = &cert
+	return true, nil
+}
+
+// SecretReloader serves the self-signed certificate stored in the Secret. The Secret is checked again and again,
+// so the certificate is renewed before it expires, and the one another replica regenerated is picked up.
+type SecretReloader struct {
+	lock        sync.RWMutex
+	secretName  string
+	namespace   string
+	serviceName string
+	caPEM       []byte
+	cert        *tls.Certificate
+	// OnCAChange is called with the caBundle to register when the CA is replaced, until it succeeds
+	OnCAChange    func(caBundle []byte) error
+	pendingBundle []byte
+}
+
+func NewSecretReloader(secretName string, namespace string, serviceName string) (*SecretReloader, error) {
+	caPEM, cert, err := EnsureSecret(secretName, namespace, serviceName)
+	if err != nil {
+		return nil, err
+	}
+	return &SecretReloader{secretName: secretName, namespace: namespace, serviceName: serviceName, caPEM: caPEM, cert: &cert}, nil
+}
+
+// CABundle returns the CA which signed the served certificate
+func (reloader *SecretReloader) CABundle() []byte {
+	reloader.lock.RLock()
+	defer reloader.lock.RUnlock()
+	return reloader.caPEM
+}
+
+func (reloader *SecretReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	reloader.lock.RLock()
+	defer reloader.lock.RUnlock()
+	return reloader.cert, nil
+}
+
+func (reloader *SecretReloader) Run(interval time.Duration, stopCh <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stopCh:
+			return
+		case <-ticker.C:
+			if err := reloader.reload(); err != nil {
+				log.Println("ERROR: Cannot reload TLS certificate from secret " + reloader.namespace + "/" + reloader.secretName + ", keep serving the previous one, because: " + err.Error())
+			}
+		}
+	}
+}
+
+func (reloader *SecretReloader) reload() error {
+	caPEM, cert, err := EnsureSecret(reloader.secretName, reloader.namespace, reloader.serviceName)
+	if err != nil {
+		return err
+	}
+	reloader.lock.Lock()
+	previousCA := reloader.caPEM
+	changed := !bytes.Equal(cert.Certificate[0], reloader.cert.Certificate[0])
+	reloader.caPEM = caPEM
+	reloader.cert = &cert
+	reloader.lock.Unlock()
+	if changed {
+		log.Println("INFO: TLS certificate is reloaded from secret " + reloader.namespace + "/" + reloader.secretName)
+	}
+	if !bytes.Equal(caPEM, previousCA) {
+		// The other replicas serve the certificate of the previous CA until they reload, so it stays trusted too
+		reloader.pendingBundle = append(append([]byte{}, caPEM...), previousCA...)
+	}
+	if reloader.pendingBundle == nil || reloader.OnCAChange == nil {
+		return nil
+	}
+	if err = reloader.OnCAChange(reloader.pendingBundle); err != nil {
+		return errors.New("Cannot register the renewed CA, because: " + err.Error())
+	}
+	reloader.pendingBundle = nil
+	return nil
+}
+
+// EnsureSecret returns the CA and serving certificate stored in the Secret, and generates new ones when they are missing or about to expire
+func EnsureSecret(secretName string, namespace string, serviceName string) ([]byte, tls.Certificate, error) {
+	secret, err := k8sclient.GetSecret(namespace, secretName)
+	if err != nil && !k8serrors.IsNotFound(err) {
+		return nil, tls.Certificate{}, errors.New("Cannot get secret " + namespace + "/" + secretName + ", because: " + err.Error())
+	}
+	dnsNames := serviceDNSNames(serviceName, namespace)
+	if secret != nil {
+		cert, err := validServingCert(secret, dnsNames)
+		if err == nil {
+			return secret.Data[CaCertKey], cert, nil
+		}
+		log.Println("INFO: Regenerating webhook certificates, because: " + err.Error())
+	}
+	caPEM, certPEM, keyPEM, err := generate(dnsNames)
+	if err != nil {
+		return nil, tls.Certificate{}, errors.New("Cannot generate certificates, because: " + err.Error())
+	}
+	newSecret := &v1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: secretName, Namespace: namespace},
+		Type:       v1.SecretTypeTLS,
+		Data: map[string][]byte{
+			CaCertKey:           caPEM,
+			v1.TLSCertKey:       certPEM,
+			v1.TLSPrivateKeyKey: keyPEM,
+		},
+	}
+	if secret == nil {
+		err = k8sclient.CreateSecret(newSecret)
+		if k8serrors.IsAlreadyExists(err) {
+			// Another replica was faster, serve what it stored
+			secret, err = k8sclient.GetSecret(namespace, secretName)
+			if err == nil {
+				cert, err := validServingCert(secret, dnsNames)
+				return secret.Data[CaCertKey], cert, err
+			}
+		}
+	} else {
+		newSecret.ObjectMeta.ResourceVersion = secret.ObjectMeta.ResourceVersion
+		err = k8sclient.UpdateSecret(newSecret)
+	}
+	if err != nil {
+		return nil, tls.Certificate{}, errors.New("Cannot store certificates in secret " + namespace + "/" + secretName + ", because: " + err.Error())
+	}
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	return caPEM, cert, err
+}
+
+func validServingCert(secret *v1.Secret, dnsNames []string) (tls.Certificate, error) {
+	if len(secret.Data[CaCertKey]) == 0 {
+		return tls.Certificate{}, errors.New("secret has no " + CaCertKey)
+	}
+	cert, err := tls.X509KeyPair(secret.Data[v1.TLSCertKey], secret.Data[v1.TLSPrivateKeyKey])
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	if time.Now().Add(renewThreshold).After(leaf.NotAfter) {
+		return tls.Certificate{}, errors.New("certificate expires at " + leaf.NotAfter.String())
+	}
+	for _, dnsName := range dnsNames {
+		if err = leaf.VerifyHostname(dnsName); err != nil {
+			return tls.Certificate{}, err
+		}
+	}
+	return cert, nil
+}
+
+func generate(dnsNames []string) ([]byte, []byte, []byte, error) {
+	notBefore := time.Now().Add(-time.Hour)
+	caKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	caTemplate := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "dynamic-local-pv-provisioner-ca"},
+		NotBefore:             notBefore,
+		NotAfter:              notBefore.Add(validity),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, caTemplate, caTemplate, &caKey.PublicKey, caKey)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: dnsNames[len(dnsNames)-1]},
+		DNSNames:     dnsNames,
+		NotBefore:    notBefore,
+		NotAfter:     notBefore.Add(validity),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	certDER, err := x509.CreateCertificate(rand.Reader, template, caTemplate, &key.PublicKey, caKey)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	caPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: caDER})
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certDER})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+	return caPEM, certPEM, keyPEM, nil
+}
+
+func serviceDNSNames(serviceName string, namespace string) []string {
+	return []string{
+		serviceName,
+		serviceName + "." + namespace,
+		serviceName + "." + namespace + ".svc",
+		serviceName + "." + namespace + ".svc.cluster.local",
+	}
+}
@@ -0,0 +1,113 @@
+package config
+
+import (
+	"errors"
+	"io/ioutil"
+	"sync/atomic"
+
+	"github.com/go-yaml/yaml"
+	v1 "k8s.io/api/core/v1"
+)
+
+const (
+	DefaultFilePath = "/etc/config/config.yml"
+	FileKey         = "config.yml"
+)
+
+// The defaultNodeSelector accepts every format of ParseSelector
+type StorageClassConfig struct {
+	DefaultNodeSelector string            `yaml:"defaultNodeSelector"`
+	ToleratedTaints     []TaintToleration `yaml:"toleratedTaints"`
+}
+
+// TaintToleration lets volumes of the StorageClass onto nodes with the taint. An empty value matches every value of
+// the key, an empty effect matches every effect, an empty key matches every taint.
+type TaintToleration struct {
+	Key    string `yaml:"key"`
+	Value  string `yaml:"value"`
+	Effect string `yaml:"effect"`
+}
+
+// Config holds the provisioner configuration of each StorageClass, keyed by the name of the class
+type Config map[string]StorageClassConfig
+
+// Store makes the active Config swappable without locking the admission requests reading it
+type Store struct {
+	current atomic.Value
+}
+
+func NewStore(config Config) *Store {
+	store := Store{}
+	store.Set(config)
+	return &store
+}
+
+func (store *Store) Get() Config {
+	return store.current.Load().(Config)
+}
+
+func (store *Store) Set(config Config) {
+	if config == nil {
+		config = Config{}
+	}
+	store.current.Store(config)
+}
+
+func LoadFile(path string) (Config, error) {
+	file, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return Parse(file)
+}
+
+func Parse(data []byte) (Config, error) {
+	config := Config{}
+	err := yaml.Unmarshal(data, &config)
+	if err != nil {
+		return nil, err
+	}
+	if err = config.Validate(); err != nil {
+		return nil, err
+	}
+	return config, nil
+}
+
+func (config Config) Validate() error {
+	for storageClass, scConfig := range config {
+		if _, err := ParseSelector(scConfig.DefaultNodeSelector); err != nil {
+			return errors.New("Invalid defaultNodeSelector of storage class " + storageClass + ": " + err.Error())
+		}
+		for _, toleration := range scConfig.ToleratedTaints {
+			if err := toleration.validate(); err != nil {
+				return errors.New("Invalid toleratedTaints of storage class " + storageClass + ": " + err.Error())
+			}
+		}
+	}
+	return nil
+}
+
+func (toleration TaintToleration) validate() error {
+	switch v1.TaintEffect(toleration.Effect) {
+	case "", v1.TaintEffectNoSchedule, v1.TaintEffectPreferNoSchedule, v1.TaintEffectNoExecute:
+	default:
+		return errors.New("unknown taint effect " + toleration.Effect)
+	}
+	if toleration.Key == "" && toleration.Value != "" {
+		return errors.New("a value cannot be tolerated without a key")
+	}
+	return nil
+}
+
+// Tolerations converts the tolerated taints to pod tolerations
+func (scConfig StorageClassConfig) Tolerations() []v1.Toleration {
+	tolerations := make([]v1.Toleration, 0, len(scConfig.ToleratedTaints))
+	for _, taint := range scConfig.ToleratedTaints {
+		toleration := v1.Toleration{Key: taint.Key, Value: taint.Value, Effect: v1.TaintEffect(taint.Effect), Operator: v1.TolerationOpEqual}
+		if taint.Value == "" {
+			toleration.Operator = v1.TolerationOpExists
+		}
+		tolerations = append(tolerations, toleration)
+	}
+	return tolerations
+}
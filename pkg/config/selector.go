@@ -0,0 +1,81 @@
+package config
+
+import (
+	"encoding/json"
+	"errors"
+	"strings"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+// ParseSelector accepts a label selector in kubectl syntax (e.g. "disk in (ssd,nvme),!maintenance"),
+// a JSON metav1.LabelSelector with matchLabels and matchExpressions, a JSON map of labels,
+// or the legacy {key:value,...} format of the defaultNodeSelector
+func ParseSelector(selector string) (labels.Selector, error) {
+	selector = strings.TrimSpace(selector)
+	if selector == "" {
+		return labels.Everything(), nil
+	}
+	if strings.HasPrefix(selector, "{") {
+		// Only selectors which are not JSON at all fall back to the legacy format,
+		// JSON which does not describe a selector is an error
+		if json.Valid([]byte(selector)) {
+			return parseJSONSelector(selector)
+		}
+		return parseLegacySelector(selector)
+	}
+	parsed, err := labels.Parse(selector)
+	if err != nil {
+		if legacy, legacyErr := parseLegacySelector(selector); legacyErr == nil {
+			return legacy, nil
+		}
+		return nil, err
+	}
+	return parsed, nil
+}
+
+// CombineSelectors requires every requirement of all the selectors
+func CombineSelectors(selectors ...labels.Selector) labels.Selector {
+	combined := labels.NewSelector()
+	for _, selector := range selectors {
+		requirements, _ := selector.Requirements()
+		combined = combined.Add(requirements...)
+	}
+	return combined
+}
+
+func parseJSONSelector(selector string) (labels.Selector, error) {
+	fields := make(map[string]json.RawMessage)
+	if err := json.Unmarshal([]byte(selector), &fields); err != nil {
+		return nil, err
+	}
+	_, hasMatchLabels := fields["matchLabels"]
+	_, hasMatchExpressions := fields["matchExpressions"]
+	if hasMatchLabels || hasMatchExpressions {
+		labelSelector := metav1.LabelSelector{}
+		if err := json.Unmarshal([]byte(selector), &labelSelector); err != nil {
+			return nil, err
+		}
+		return metav1.LabelSelectorAsSelector(&labelSelector)
+	}
+	labelMap := make(map[string]string)
+	if err := json.Unmarshal([]byte(selector), &labelMap); err != nil {
+		return nil, err
+	}
+	return labels.ValidatedSelectorFromSet(labelMap)
+}
+
+func parseLegacySelector(selector string) (labels.Selector, error) {
+	labelMap := make(map[string]string)
+	for _, pair := range strings.Split(strings.Trim(selector, "{}"), ",") {
+		keyValue := strings.Split(pair, ":")
+		if len(keyValue) != 2 {
+			return nil, errors.New(pair + " is not a key:value pair")
+		}
+		key := strings.Trim(strings.TrimSpace(keyValue[0]), "\"")
+		value := strings.Trim(strings.TrimSpace(keyValue[1]), "\"")
+		labelMap[key] = value
+	}
+	return labels.ValidatedSelectorFromSet(labelMap)
+}
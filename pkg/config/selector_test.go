@@ -0,0 +1,108 @@
+package config
+
+import (
+	"testing"
+
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+func TestParseSelector(t *testing.T) {
+	tests := []struct {
+		name     string
+		selector string
+		matches  []labels.Set
+		rejects  []labels.Set
+		wantErr  bool
+	}{
+		{
+			name:     "empty",
+			selector: "  ",
+			matches:  []labels.Set{{}, {"disk": "ssd"}},
+		},
+		{
+			name:     "kubectl equality",
+			selector: "disk=ssd,zone!=a",
+			matches:  []labels.Set{{"disk": "ssd", "zone": "b"}},
+			rejects:  []labels.Set{{"disk": "ssd", "zone": "a"}, {"disk": "hdd"}},
+		},
+		{
+			name:     "kubectl set based",
+			selector: "disk in (ssd,nvme),!maintenance",
+			matches:  []labels.Set{{"disk": "nvme"}},
+			rejects:  []labels.Set{{"disk": "hdd"}, {"disk": "ssd", "maintenance": "true"}},
+		},
+		{
+			name:     "kubectl invalid",
+			selector: "disk in (ssd",
+			wantErr:  true,
+		},
+		{
+			name:     "JSON label selector",
+			selector: `{"matchLabels":{"disk":"ssd"},"matchExpressions":[{"key":"zone","operator":"NotIn","values":["a"]}]}`,
+			matches:  []labels.Set{{"disk": "ssd", "zone": "b"}},
+			rejects:  []labels.Set{{"disk": "ssd", "zone": "a"}, {"zone": "b"}},
+		},
+		{
+			name:     "JSON label selector with invalid operator",
+			selector: `{"matchExpressions":[{"key":"zone","operator":"Near","values":["a"]}]}`,
+			wantErr:  true,
+		},
+		{
+			name:     "JSON label map",
+			selector: `{"disk": "ssd", "tier": "fast"}`,
+			matches:  []labels.Set{{"disk": "ssd", "tier": "fast", "zone": "a"}},
+			rejects:  []labels.Set{{"disk": "ssd"}},
+		},
+		{
+			name:     "JSON with non string value",
+			selector: `{"a": 1}`,
+			wantErr:  true,
+		},
+		{
+			name:     "JSON with invalid label value",
+			selector: `{"disk": "s s d"}`,
+			wantErr:  true,
+		},
+		{
+			name:     "legacy",
+			selector: "{disk:ssd, tier:fast}",
+			matches:  []labels.Set{{"disk": "ssd", "tier": "fast"}},
+			rejects:  []labels.Set{{"disk": "ssd"}},
+		},
+		{
+			name:     "legacy without braces",
+			selector: "disk:ssd",
+			matches:  []labels.Set{{"disk": "ssd"}},
+			rejects:  []labels.Set{{"disk": "hdd"}},
+		},
+		{
+			name:     "legacy without value",
+			selector: "{disk}",
+			wantErr:  true,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			selector, err := ParseSelector(test.selector)
+			if test.wantErr {
+				if err == nil {
+					t.Fatalf("ParseSelector(%q) = %v, want error", test.selector, selector)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("ParseSelector(%q) failed: %v", test.selector, err)
+			}
+			for _, set := range test.matches {
+				if !selector.Matches(set) {
+					t.Errorf("ParseSelector(%q) = %v does not match %v", test.selector, selector, set)
+				}
+			}
+			for _, set := range test.rejects {
+				if selector.Matches(set) {
+					t.Errorf("ParseSelector(%q) = %v matches %v", test.selector, selector, set)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,69 @@
+package config
+
+import (
+	"log"
+
+	"github.com/nokia/dynamic-local-pv-provisioner/pkg/k8sclient"
+	"github.com/nokia/dynamic-local-pv-provisioner/pkg/metrics"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/tools/record"
+)
+
+// Watcher follows the ConfigMap of the provisioner and swaps every valid revision into the Store
+type Watcher struct {
+	store    *Store
+	recorder record.EventRecorder
+	informer cache.SharedIndexInformer
+}
+
+func NewWatcher(namespace string, name string, store *Store) (*Watcher, error) {
+	recorder, err := k8sclient.NewEventRecorder("dynamic-local-pv-provisioner")
+	if err != nil {
+		return nil, err
+	}
+	informer, err := k8sclient.NewConfigMapInformer(namespace, name)
+	if err != nil {
+		return nil, err
+	}
+	watcher := Watcher{store: store, recorder: recorder, informer: informer}
+	informer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc: func(obj interface{}) {
+			watcher.configMapChanged(obj.(*v1.ConfigMap))
+		},
+		UpdateFunc: func(oldObj, newObj interface{}) {
+			oldConfigMap, newConfigMap := oldObj.(*v1.ConfigMap), newObj.(*v1.ConfigMap)
+			// Periodic resyncs deliver the same revision again, which is already active
+			if oldConfigMap.ObjectMeta.ResourceVersion == newConfigMap.ObjectMeta.ResourceVersion {
+				return
+			}
+			watcher.configMapChanged(newConfigMap)
+		},
+		DeleteFunc: func(obj interface{}) {
+			log.Println("WARNING: ConfigMap " + namespace + "/" + name + " is deleted, keep using the last valid configuration")
+		},
+	})
+	return &watcher, nil
+}
+
+func (watcher *Watcher) Run(stopCh <-chan struct{}) {
+	watcher.informer.Run(stopCh)
+}
+
+func (watcher *Watcher) HasSynced() bool {
+	return watcher.informer.HasSynced()
+}
+
+func (watcher *Watcher) configMapChanged(configMap *v1.ConfigMap) {
+	config, err := Parse([]byte(configMap.Data[FileKey]))
+	if err != nil {
+		log.Println("ERROR: Rejected configuration from ConfigMap " + configMap.ObjectMeta.Namespace + "/" + configMap.ObjectMeta.Name + ", keep using the previous one, because: " + err.Error())
+		metrics.ConfigReloads.WithLabelValues("rejected").Inc()
+		watcher.recorder.Event(configMap, v1.EventTypeWarning, "ConfigRejected", "Configuration is rejected, the previous one stays active: "+err.Error())
+		return
+	}
+	watcher.store.Set(config)
+	log.Println("INFO: Configuration is reloaded from ConfigMap " + configMap.ObjectMeta.Namespace + "/" + configMap.ObjectMeta.Name)
+	metrics.ConfigReloads.WithLabelValues("success").Inc()
+	watcher.recorder.Event(configMap, v1.EventTypeNormal, "ConfigReloaded", "Configuration is reloaded")
+}
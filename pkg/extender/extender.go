@@ -0,0 +1,267 @@
+package extender
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"log"
+	"net/http"
+
+	"github.com/nokia/dynamic-local-pv-provisioner/pkg/config"
+	"github.com/nokia/dynamic-local-pv-provisioner/pkg/k8sclient"
+	"github.com/nokia/dynamic-local-pv-provisioner/pkg/nodeselector"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	"k8s.io/apimachinery/pkg/labels"
+	extenderv1 "k8s.io/kube-scheduler/extender/v1"
+)
+
+type Extender struct {
+	nodeLabel        labels.Selector
+	nodeSelectMethod string
+	nodeChecks       []nodeselector.NodeCheck
+}
+
+// localClaims collects what the local PVCs of a pod demand from its node
+type localClaims struct {
+	requiredNodes map[string]string
+	unplacedSize  resource.Quantity
+	unplacedCount int
+	// storageClass of the first unplaced claim decides the node selector method
+	storageClass string
+}
+
+func NewExtender(method string, nodeLabel string) (*Extender, error) {
+	selector, err := config.ParseSelector(nodeLabel)
+	if err != nil {
+		return nil, errors.New("Cannot parse node label " + nodeLabel + ", because: " + err.Error())
+	}
+	if _, err = nodeselector.Get(method); err != nil {
+		return nil, err
+	}
+	return &Extender{nodeLabel: selector, nodeSelectMethod: method}, nil
+}
+
+// AddNodeCheck rejects the nodes failing the check in both the filter and the prioritize step
+func (extender *Extender) AddNodeCheck(check nodeselector.NodeCheck) {
+	extender.nodeChecks = append(extender.nodeChecks, check)
+}
+
+func (extender *Extender) ServeFilter(w http.ResponseWriter, r *http.Request) {
+	var (
+		args   extenderv1.ExtenderArgs
+		result extenderv1.ExtenderFilterResult
+	)
+	if err := decodeArgs(r, &args); err != nil {
+		log.Println("ERROR: Decode filter arguments is failed, because " + err.Error())
+		result.Error = err.Error()
+		writeResponse(w, result)
+		return
+	}
+	nodes, err := candidateNodes(args)
+	if err != nil {
+		log.Println("ERROR: Cannot get candidate nodes, because " + err.Error())
+		result.Error = err.Error()
+		writeResponse(w, result)
+		return
+	}
+	claims, err := collectLocalClaims(args.Pod)
+	if err != nil {
+		log.Println("ERROR: Cannot collect local pvcs of pod " + args.Pod.ObjectMeta.Namespace + "/" + args.Pod.ObjectMeta.Name + ", because " + err.Error())
+		result.Error = err.Error()
+		writeResponse(w, result)
+		return
+	}
+	fitNodes, failedNodes, err := extender.filterNodes(nodes, claims)
+	if err != nil {
+		log.Println("ERROR: Cannot filter nodes for pod " + args.Pod.ObjectMeta.Namespace + "/" + args.Pod.ObjectMeta.Name + ", because " + err.Error())
+		result.Error = err.Error()
+		writeResponse(w, result)
+		return
+	}
+	result.FailedNodes = failedNodes
+	if args.NodeNames != nil {
+		nodeNames := make([]string, 0, len(fitNodes))
+		for _, node := range fitNodes {
+			nodeNames = append(nodeNames, node.ObjectMeta.Name)
+		}
+		result.NodeNames = &nodeNames
+	} else {
+		result.Nodes = &v1.NodeList{Items: fitNodes}
+	}
+	writeResponse(w, result)
+}
+
+func (extender *Extender) ServePrioritize(w http.ResponseWriter, r *http.Request) {
+	var args extenderv1.ExtenderArgs
+	priorities := extenderv1.HostPriorityList{}
+	if err := decodeArgs(r, &args); err != nil {
+		log.Println("ERROR: Decode prioritize arguments is failed, because " + err.Error())
+		writeResponse(w, priorities)
+		return
+	}
+	nodes, err := candidateNodes(args)
+	if err != nil {
+		log.Println("ERROR: Cannot get candidate nodes, because " + err.Error())
+		writeResponse(w, priorities)
+		return
+	}
+	claims, err := collectLocalClaims(args.Pod)
+	if err != nil {
+		log.Println("ERROR: Cannot collect local pvcs of pod " + args.Pod.ObjectMeta.Namespace + "/" + args.Pod.ObjectMeta.Name + ", because " + err.Error())
+		writeResponse(w, priorities)
+		return
+	}
+	scores := make(map[string]int64)
+	// Only the placement of not-yet-placed volumes is up to the node selector method
+	if claims.unplacedCount > 0 {
+		scores, err = extender.scoreNodes(nodes, claims)
+		if err != nil {
+			log.Println("ERROR: Cannot score nodes for pod " + args.Pod.ObjectMeta.Namespace + "/" + args.Pod.ObjectMeta.Name + ", because " + err.Error())
+		}
+	}
+	for _, node := range nodes {
+		priorities = append(priorities, extenderv1.HostPriority{Host: node.ObjectMeta.Name, Score: scores[node.ObjectMeta.Name]})
+	}
+	writeResponse(w, priorities)
+}
+
+// filterNodes keeps the nodes which host every placed claim of the pod and which the node selector method
+// would accept for the unplaced ones, the scheduler passes only these nodes to the prioritize step
+func (extender *Extender) filterNodes(nodes []v1.Node, claims localClaims) ([]v1.Node, extenderv1.FailedNodesMap, error) {
+	fitNodes := []v1.Node{}
+	failedNodes := make(extenderv1.FailedNodesMap)
+	for _, node := range nodes {
+		if reason := extender.nodeCannotHost(node, claims); reason != "" {
+			failedNodes[node.ObjectMeta.Name] = reason
+			continue
+		}
+		fitNodes = append(fitNodes, node)
+	}
+	if claims.unplacedCount == 0 || len(fitNodes) == 0 {
+		return fitNodes, failedNodes, nil
+	}
+	_, strategy, err := nodeselector.ForStorageClass(claims.storageClass, extender.nodeSelectMethod)
+	if err != nil {
+		return nil, nil, err
+	}
+	fitNodes, rejected := nodeselector.Filter(strategy, extender.request(claims), fitNodes)
+	for nodeName, reason := range rejected {
+		failedNodes[nodeName] = reason
+	}
+	return fitNodes, failedNodes, nil
+}
+
+// scoreNodes ranks the nodes the scheduler has filtered already, including by the filter step of the extender.
+// Scoring only peeks, as the webhook places the claims and the scheduler calls prioritize for every attempt.
+func (extender *Extender) scoreNodes(nodes []v1.Node, claims localClaims) (map[string]int64, error) {
+	if len(nodes) == 0 {
+		return map[string]int64{}, nil
+	}
+	_, strategy, err := nodeselector.ForStorageClass(claims.storageClass, extender.nodeSelectMethod)
+	if err != nil {
+		return map[string]int64{}, err
+	}
+	request := extender.request(claims)
+	request.Peek = true
+	return nodeselector.Normalize(strategy.Score(request, nodes), extenderv1.MaxExtenderPriority), nil
+}
+
+// request asks for the unplaced claims of the pod, the scheduler has checked cordons, taints and node selectors
+func (extender *Extender) request(claims localClaims) *nodeselector.Request {
+	return &nodeselector.Request{
+		Size:              claims.unplacedSize,
+		Selector:          extender.nodeLabel.String(),
+		SchedulerFiltered: true,
+		NodeChecks:        extender.nodeChecks,
+	}
+}
+
+func (extender *Extender) nodeCannotHost(node v1.Node, claims localClaims) string {
+	for pvcName, nodeName := range claims.requiredNodes {
+		if nodeName != node.ObjectMeta.Name {
+			return "local pvc " + pvcName + " is placed on node " + nodeName
+		}
+	}
+	if claims.unplacedCount > 0 && !extender.nodeLabel.Matches(labels.Set(node.ObjectMeta.Labels)) {
+		return "node is not selected for dynamic local pvs"
+	}
+	return ""
+}
+
+func collectLocalClaims(pod *v1.Pod) (localClaims, error) {
+	claims := localClaims{requiredNodes: make(map[string]string)}
+	if pod == nil {
+		return claims, errors.New("Pod is missing from the extender arguments")
+	}
+	for _, volume := range pod.Spec.Volumes {
+		if volume.PersistentVolumeClaim == nil {
+			continue
+		}
+		pvc, err := k8sclient.GetPvc(pod.ObjectMeta.Namespace, volume.PersistentVolumeClaim.ClaimName)
+		if err != nil {
+			return claims, err
+		}
+		// Bound volumes are already pinned to their node by the node affinity of the pv
+		if pvc.Status.Phase == v1.ClaimBound || pvc.Spec.StorageClassName == nil {
+			continue
+		}
+		isLocal, err := k8sclient.StorageClassIsNokiaLocal(*(pvc.Spec.StorageClassName))
+		if err != nil {
+			return claims, err
+		}
+		if !isLocal {
+			continue
+		}
+		if nodeName, ok := pvc.ObjectMeta.Annotations[k8sclient.NodeName]; ok {
+			claims.requiredNodes[pvc.ObjectMeta.Name] = nodeName
+			continue
+		}
+		if claims.unplacedCount == 0 {
+			claims.storageClass = *pvc.Spec.StorageClassName
+		}
+		claims.unplacedSize.Add(pvc.Spec.Resources.Requests[v1.ResourceStorage])
+		claims.unplacedCount++
+	}
+	return claims, nil
+}
+
+func candidateNodes(args extenderv1.ExtenderArgs) ([]v1.Node, error) {
+	if args.Nodes != nil {
+		return args.Nodes.Items, nil
+	}
+	nodes := []v1.Node{}
+	if args.NodeNames == nil {
+		return nodes, nil
+	}
+	for _, nodeName := range *args.NodeNames {
+		node, err := k8sclient.GetNode(nodeName)
+		if err != nil {
+			return nil, err
+		}
+		nodes = append(nodes, *node)
+	}
+	return nodes, nil
+}
+
+func decodeArgs(r *http.Request, args *extenderv1.ExtenderArgs) error {
+	if r.Body == nil {
+		return errors.New("Request body is empty")
+	}
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(body, args)
+}
+
+func writeResponse(w http.ResponseWriter, response interface{}) {
+	respBytes, err := json.Marshal(response)
+	if err != nil {
+		log.Println("ERROR: Marshal extender response is failed, because " + err.Error())
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if _, err := w.Write(respBytes); err != nil {
+		log.Println("ERROR: Write response is failed, because " + err.Error())
+	}
+}
@@ -11,12 +11,14 @@ import (
 	"reflect"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/nokia/dynamic-local-pv-provisioner/pkg/k8sclient"
 
 	syscall "golang.org/x/sys/unix"
 	v1 "k8s.io/api/core/v1"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
 	"k8s.io/client-go/informers"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/rest"
@@ -26,9 +28,20 @@ import (
 const (
 	fstabPath           = "/rootfs/fstab"
 	pvDirNameAnnotation = "nokia.k8s.io/pvDirName"
+	// A claim the node does not refuse is provisioned again after 10s, 20s, 40s, 80s and 160s before it is
+	// marked failed on the node
+	provisionRetries = 5
+	provisionBackoff = 10 * time.Second
 )
 
+// refusal is a reason the node never provisions the claim for, so the claim is marked failed on the node at once
+type refusal struct {
+	error
+}
+
 type PvcHandler struct {
+	// lock serializes the provisioning, the project ids are derived from the last line of /etc/projects
+	lock        sync.Mutex
 	nodeName    string
 	storagePath string
 	k8sClient   kubernetes.Interface
@@ -66,18 +79,18 @@ func (pvcHandler *PvcHandler) CreateController() cache.Controller {
 
 func (pvcHandler *PvcHandler) pvcAdded(pvc v1.PersistentVolumeClaim) {
 	handlePvc, pvDirPath := shouldPvcBeHandled(v1.PersistentVolumeClaim{}, pvc, pvcHandler.nodeName, pvcHandler.storagePath)
-	if !handlePvc || !pvcHandler.enoughLvCapacity(pvc) {
+	if !handlePvc {
 		return
 	}
-	pvcHandler.createPVStorage(pvc, pvDirPath)
+	pvcHandler.provision(pvc, pvDirPath)
 }
 
 func (pvcHandler *PvcHandler) pvcChanged(oldPvc v1.PersistentVolumeClaim, newPvc v1.PersistentVolumeClaim) {
 	handlePvc, pvDirPath := shouldPvcBeHandled(oldPvc, newPvc, pvcHandler.nodeName, pvcHandler.storagePath)
-	if !handlePvc || !pvcHandler.enoughLvCapacity(newPvc) {
+	if !handlePvc {
 		return
 	}
-	pvcHandler.createPVStorage(newPvc, pvDirPath)
+	pvcHandler.provision(newPvc, pvDirPath)
 }
 
 func (pvcHandler *PvcHandler) pvcDeleted(pvc v1.PersistentVolumeClaim) {
@@ -91,18 +104,68 @@ func (pvcHandler *PvcHandler) pvcDeleted(pvc v1.PersistentVolumeClaim) {
 	}
 }
 
-func (pvcHandler *PvcHandler) enoughLvCapacity(pvc v1.PersistentVolumeClaim) bool {
+// provision creates the storage of the claim, or marks the claim failed on this node so it can be rescheduled
+func (pvcHandler *PvcHandler) provision(pvc v1.PersistentVolumeClaim, pvDirPath string) {
+	pvcHandler.provisionAttempt(pvc, pvDirPath, 0)
+}
+
+// provisionAttempt marks the claim failed when the node refuses it or the last retry fails, the other failures are
+// retried with backoff
+func (pvcHandler *PvcHandler) provisionAttempt(pvc v1.PersistentVolumeClaim, pvDirPath string, attempt int) {
+	pvcHandler.lock.Lock()
+	defer pvcHandler.lock.Unlock()
+	key := pvc.ObjectMeta.Namespace + "/" + pvc.ObjectMeta.Name
+	err := pvcHandler.canProvision(pvc)
+	if err == nil {
+		err = pvcHandler.createPVStorage(pvc, pvDirPath)
+	}
+	if err == nil {
+		return
+	}
+	log.Println("PvcHandler ERROR: Cannot provision pvc " + key + ", because: " + err.Error())
+	if _, refused := err.(refusal); !refused && attempt < provisionRetries {
+		delay := provisionBackoff << uint(attempt)
+		log.Println("PvcHandler INFO: Retrying pvc " + key + " in " + delay.String())
+		time.AfterFunc(delay, func() {
+			pvcHandler.retryProvision(pvc, attempt+1)
+		})
+		return
+	}
+	if err = k8sclient.MarkProvisioningFailed(pvc.ObjectMeta.Namespace, pvc.ObjectMeta.Name, pvcHandler.nodeName, err.Error()); err != nil {
+		log.Println("PvcHandler ERROR: Cannot mark pvc " + key + " failed, because: " + err.Error())
+	}
+}
+
+// retryProvision provisions the claim again, unless it is gone, bound or placed elsewhere meanwhile
+func (pvcHandler *PvcHandler) retryProvision(pvc v1.PersistentVolumeClaim, attempt int) {
+	current, err := k8sclient.GetPvc(pvc.ObjectMeta.Namespace, pvc.ObjectMeta.Name)
+	if k8serrors.IsNotFound(err) || (err == nil && current.ObjectMeta.UID != pvc.ObjectMeta.UID) {
+		return
+	}
+	if err == nil {
+		pvc = *current
+	}
+	handlePvc, pvDirPath := shouldPvcBeHandled(v1.PersistentVolumeClaim{}, pvc, pvcHandler.nodeName, pvcHandler.storagePath)
+	if !handlePvc {
+		return
+	}
+	pvcHandler.provisionAttempt(pvc, pvDirPath, attempt)
+}
+
+// canProvision refuses new volumes on nodes in maintenance, deleting the existing ones goes on
+func (pvcHandler *PvcHandler) canProvision(pvc v1.PersistentVolumeClaim) error {
 	node, err := k8sclient.GetNode(pvcHandler.nodeName)
 	if err != nil {
-		log.Println("PvcHandler ERROR: Cannot get node: " + pvcHandler.nodeName + ", because: " + err.Error())
-		return false
+		return errors.New("Cannot get node: " + pvcHandler.nodeName + ", because: " + err.Error())
+	}
+	if k8sclient.NodeInMaintenance(node) {
+		return refusal{errors.New("Node " + pvcHandler.nodeName + " is in local storage maintenance")}
 	}
 	nodeCapacity := node.Status.Capacity[k8sclient.LvCapacity]
 	if (&nodeCapacity).Cmp(pvc.Spec.Resources.Requests["storage"]) < 0 {
-		log.Println("PvcHandler ERROR: Not enough free space in storage!")
-		return false
+		return refusal{errors.New("Not enough free space in storage!")}
 	}
-	return true
+	return nil
 }
 
 func shouldPvcBeHandled(oldPvc v1.PersistentVolumeClaim, newPvc v1.PersistentVolumeClaim, nodeName string, storagePath string) (bool, string) {
@@ -111,8 +174,12 @@ func shouldPvcBeHandled(oldPvc v1.PersistentVolumeClaim, newPvc v1.PersistentVol
 		if pvcNodeName, ok := newPvc.ObjectMeta.Annotations[k8sclient.NodeName]; ok && pvcNodeName == nodeName {
 			if newPvc.Status.Phase == v1.ClaimPending {
 				if pvDirName, ok := newPvc.ObjectMeta.Annotations[pvDirNameAnnotation]; ok {
-					pvDir := storagePath + pvDirName
-					if _, err := os.Stat(pvDir); os.IsNotExist(err) {
+					pvDir, err := pvDirPath(storagePath, pvDirName)
+					if err != nil {
+						log.Println("PvcHandler ERROR: Refusing pvc " + newPvc.ObjectMeta.Namespace + "/" + newPvc.ObjectMeta.Name + ", because: " + err.Error())
+						return false, ""
+					}
+					if _, err := os.Lstat(pvDir); os.IsNotExist(err) {
 						return true, pvDir
 					}
 				}
@@ -131,94 +198,115 @@ func shouldDeletePvcBeHandled(pvc v1.PersistentVolumeClaim, nodeName string) boo
 	return false
 }
 
-func (pvcHandler *PvcHandler) createPVStorage(pvc v1.PersistentVolumeClaim, pvDirPath string) {
+// createPVStorage undoes what it has done on the host when it fails, so the claim can be provisioned again
+func (pvcHandler *PvcHandler) createPVStorage(pvc v1.PersistentVolumeClaim, pvDirPath string) (err error) {
 	var projID int = 1
 	pvcStorageReq, ok := pvc.Spec.Resources.Requests["storage"]
 	if !ok {
-		log.Println("PvcHandler ERROR: Storage request is empty!")
-		return
+		return refusal{errors.New("Storage request is empty!")}
 	}
+	var undo []func() error
+	defer func() {
+		if err == nil {
+			return
+		}
+		for i := len(undo) - 1; i >= 0; i-- {
+			if undoErr := undo[i](); undoErr != nil {
+				log.Println("PvcHandler ERROR: Cannot roll back the storage of pvc " + pvc.ObjectMeta.Namespace + "/" + pvc.ObjectMeta.Name + ", because: " + undoErr.Error())
+			}
+		}
+	}()
 	storageRequest := strconv.FormatInt((&pvcStorageReq).Value(), 10)
 	projectsContent, err := ioutil.ReadFile("/etc/projects")
 	if err != nil {
-		log.Println("PvcHandler ERROR: Cannot read /etc/projects file: " + err.Error())
-		return
+		return errors.New("Cannot read /etc/projects file: " + err.Error())
 	}
 	if string(projectsContent) != "" {
 		lines := strings.Split(strings.TrimRight(string(projectsContent), "\n"), "\n")
 		projid, err := strconv.Atoi(strings.Split(lines[len(lines)-1], ":")[0])
 		if err != nil {
-			log.Println("PvcHandler ERROR: Cannot convert project id from " + lines[len(lines)-1] + " because: " + err.Error())
-			return
+			return errors.New("Cannot convert project id from " + lines[len(lines)-1] + " because: " + err.Error())
 		}
 		projID = projid + 1
 	}
 	// create directory with new projID
 	err = os.Mkdir(pvDirPath, os.ModePerm)
 	if err != nil {
-		log.Println("PvcHandler ERROR: Cannot create directory on host, because: " + err.Error())
-		return
+		return errors.New("Cannot create directory on host, because: " + err.Error())
 	}
+	undo = append(undo, func() error {
+		return os.Remove(pvDirPath)
+	})
 
 	projFile, err := os.OpenFile("/etc/projects", os.O_APPEND|os.O_WRONLY|os.O_SYNC, 0755)
 	if err != nil {
-		log.Println("PvcHandler ERROR: Cannot open /etc/projects file, because: " + err.Error())
-		return
+		return errors.New("Cannot open /etc/projects file, because: " + err.Error())
 	}
 	defer projFile.Close()
 	project := fmt.Sprintf("%d:%s\n", projID, pvDirPath)
 	_, err = projFile.WriteString(project)
 	if err != nil {
-		log.Println("PvcHandler ERROR: Cannot modify /etc/projects file, because: " + err.Error())
-		return
+		return errors.New("Cannot modify /etc/projects file, because: " + err.Error())
 	}
+	// removePvDataFromFile drops the first line when nothing matches, so only a written line is rolled back
+	undo = append(undo, func() error {
+		return removePvDataFromFile("/etc/projects", strings.TrimSuffix(project, "\n"))
+	})
 	projIdFile, err := os.OpenFile("/etc/projid", os.O_APPEND|os.O_WRONLY|os.O_SYNC, 0755)
 	if err != nil {
-		log.Println("PvcHandler ERROR: Cannot open /etc/projid file, because: " + err.Error())
-		return
+		return errors.New("Cannot open /etc/projid file, because: " + err.Error())
 	}
 	defer projIdFile.Close()
 	projName := filepath.Base(pvDirPath)
 	projid := fmt.Sprintf("%s:%d\n", projName, projID)
 	_, err = projIdFile.WriteString(projid)
 	if err != nil {
-		log.Println("PvcHandler ERROR: Cannot modify /etc/projid file, because: " + err.Error())
-		return
+		return errors.New("Cannot modify /etc/projid file, because: " + err.Error())
 	}
+	undo = append(undo, func() error {
+		return removePvDataFromFile("/etc/projid", strings.TrimSuffix(projid, "\n"))
+	})
 	// set xfs_quota limit
 	subcommand := fmt.Sprintf("project -s %s", projName)
 	command := exec.Command("xfs_quota", "-x", "-c", subcommand, pvcHandler.storagePath)
 	_, err = command.CombinedOutput()
 	if err != nil {
-		log.Println("PvcHandler ERROR: Cannot set xfs_quota project, because: " + err.Error())
-		return
+		return errors.New("Cannot set xfs_quota project, because: " + err.Error())
 	}
+	undo = append(undo, func() error {
+		for _, subcommand := range []string{"limit -p bsoft=0 bhard=0 " + projName, "project -C " + projName} {
+			if output, err := exec.Command("xfs_quota", "-x", "-c", subcommand, pvcHandler.storagePath).CombinedOutput(); err != nil {
+				return errors.New("Cannot clear xfs_quota project " + projName + ", because: " + err.Error() + ", " + string(output))
+			}
+		}
+		return nil
+	})
 	subcommand = fmt.Sprintf("limit -p bhard=%s %s", storageRequest, projName)
 	command = exec.Command("xfs_quota", "-x", "-c", subcommand, pvcHandler.storagePath)
 	_, err = command.CombinedOutput()
 	if err != nil {
-		log.Println("PvcHandler ERROR: Cannot set xfs_quota limit, because: " + err.Error())
-		return
+		return errors.New("Cannot set xfs_quota limit, because: " + err.Error())
 	}
 	// Bind mounting
 	err = syscall.Mount(pvDirPath, pvDirPath, "none", syscall.MS_BIND, "")
 	if err != nil {
-		log.Println("PvcHandler ERROR: bind mount directories, because: " + err.Error())
-		return
+		return errors.New("Cannot bind mount directories, because: " + err.Error())
 	}
+	undo = append(undo, func() error {
+		return syscall.Unmount(pvDirPath, 0)
+	})
 	// Set fstab file
 	file, err := os.OpenFile(fstabPath, os.O_APPEND|os.O_WRONLY|os.O_SYNC, 0755)
 	if err != nil {
-		log.Println("PvcHandler ERROR: Cannot open fstab file: " + fstabPath + " because: " + err.Error() + "\nCannot save mountpoint!")
-		return
+		return errors.New("Cannot open fstab file: " + fstabPath + " because: " + err.Error() + "\nCannot save mountpoint!")
 	}
 	defer file.Close()
 	bindMountCommand := fmt.Sprintf("%[1]s %[1]s none bind 0 0\n", pvDirPath)
 	_, err = file.WriteString(bindMountCommand)
 	if err != nil {
-		log.Println("PvcHandler ERROR: Cannot modify fstab file: " + fstabPath + " because: " + err.Error() + "\nCannot save mountpoint!")
-		return
+		return errors.New("Cannot modify fstab file: " + fstabPath + " because: " + err.Error() + "\nCannot save mountpoint!")
 	}
+	return nil
 }
 
 // TODO: Relocate to pvHandler and processing it in multiple threads
@@ -226,7 +314,14 @@ func deletePVStorage(pv v1.PersistentVolume, storagePath string) {
 	if pv.Spec.PersistentVolumeReclaimPolicy != v1.PersistentVolumeReclaimDelete {
 		return
 	}
+	if pv.Spec.Local == nil {
+		return
+	}
 	localVolumePath := pv.Spec.Local.Path
+	if err := confinePath(storagePath, localVolumePath); err != nil {
+		log.Println("PvcHandler ERROR: Refusing to delete storage of pv " + pv.ObjectMeta.Name + ", because: " + err.Error())
+		return
+	}
 	// unmount pv directory
 	err := syscall.Unmount(localVolumePath, 0)
 	if err != nil {
@@ -268,6 +363,31 @@ func deletePVStorage(pv v1.PersistentVolume, storagePath string) {
 	}
 }
 
+// pvDirPath derives the host path of a volume, which must be a direct child of the storage path
+func pvDirPath(storagePath string, pvDirName string) (string, error) {
+	if pvDirName == "" || pvDirName == "." || pvDirName == ".." || strings.ContainsRune(pvDirName, filepath.Separator) {
+		return "", errors.New("Invalid pvDirName: " + pvDirName)
+	}
+	pvDir := filepath.Join(storagePath, pvDirName)
+	if err := confinePath(storagePath, pvDir); err != nil {
+		return "", err
+	}
+	return pvDir, nil
+}
+
+func confinePath(storagePath string, path string) error {
+	root := filepath.Clean(storagePath)
+	cleanPath := filepath.Clean(path)
+	if filepath.Dir(cleanPath) != root || cleanPath == root {
+		return errors.New("Path " + path + " is not directly under storage path " + storagePath)
+	}
+	// A symlink would redirect mounts and quota projects outside of the storage path
+	if info, err := os.Lstat(cleanPath); err == nil && info.Mode()&os.ModeSymlink != 0 {
+		return errors.New("Path " + path + " is a symlink")
+	}
+	return nil
+}
+
 func removePvDataFromFile(filePath string, searchData string) error {
 	var removedList []string
 	fileContent, err := ioutil.ReadFile(filePath)
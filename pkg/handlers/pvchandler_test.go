@@ -0,0 +1,92 @@
+package handlers
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestPvDirPath(t *testing.T) {
+	storagePath := t.TempDir()
+	outside := t.TempDir()
+	if err := os.Symlink(outside, filepath.Join(storagePath, "escape")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Mkdir(filepath.Join(storagePath, "existing"), os.ModePerm); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name        string
+		storagePath string
+		pvDirName   string
+		want        string
+		wantErr     bool
+	}{
+		{name: "plain", storagePath: storagePath, pvDirName: "pv1", want: filepath.Join(storagePath, "pv1")},
+		{name: "trailing slash", storagePath: storagePath + "/", pvDirName: "pv1", want: filepath.Join(storagePath, "pv1")},
+		{name: "double trailing slash", storagePath: storagePath + "//", pvDirName: "pv1", want: filepath.Join(storagePath, "pv1")},
+		{name: "existing directory", storagePath: storagePath, pvDirName: "existing", want: filepath.Join(storagePath, "existing")},
+		{name: "empty", storagePath: storagePath, pvDirName: "", wantErr: true},
+		{name: "dot", storagePath: storagePath, pvDirName: ".", wantErr: true},
+		{name: "parent", storagePath: storagePath, pvDirName: "..", wantErr: true},
+		{name: "parent prefix", storagePath: storagePath, pvDirName: "../etc", wantErr: true},
+		{name: "absolute", storagePath: storagePath, pvDirName: "/etc", wantErr: true},
+		{name: "nested", storagePath: storagePath, pvDirName: "a/b", wantErr: true},
+		{name: "trailing slash in name", storagePath: storagePath, pvDirName: "pv1/", wantErr: true},
+		{name: "symlink", storagePath: storagePath, pvDirName: "escape", wantErr: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := pvDirPath(test.storagePath, test.pvDirName)
+			if test.wantErr {
+				if err == nil {
+					t.Fatalf("pvDirPath(%q, %q) = %q, want error", test.storagePath, test.pvDirName, got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("pvDirPath(%q, %q) failed: %v", test.storagePath, test.pvDirName, err)
+			}
+			if got != test.want {
+				t.Errorf("pvDirPath(%q, %q) = %q, want %q", test.storagePath, test.pvDirName, got, test.want)
+			}
+		})
+	}
+}
+
+func TestConfinePath(t *testing.T) {
+	storagePath := t.TempDir()
+	if err := os.Symlink(t.TempDir(), filepath.Join(storagePath, "escape")); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name        string
+		storagePath string
+		path        string
+		wantErr     bool
+	}{
+		{name: "direct child", storagePath: storagePath, path: filepath.Join(storagePath, "pv1")},
+		{name: "trailing slash on storage path", storagePath: storagePath + "/", path: filepath.Join(storagePath, "pv1")},
+		{name: "trailing slash on path", storagePath: storagePath, path: filepath.Join(storagePath, "pv1") + "/"},
+		{name: "storage path itself", storagePath: storagePath, path: storagePath, wantErr: true},
+		{name: "storage path with trailing slash", storagePath: storagePath + "/", path: storagePath, wantErr: true},
+		{name: "nested", storagePath: storagePath, path: filepath.Join(storagePath, "a", "b"), wantErr: true},
+		{name: "escaping with parent", storagePath: storagePath, path: storagePath + "/../pv1", wantErr: true},
+		{name: "parent resolving back", storagePath: storagePath, path: storagePath + "/a/../pv1"},
+		{name: "sibling with common prefix", storagePath: storagePath, path: storagePath + "-other/pv1", wantErr: true},
+		{name: "relative", storagePath: storagePath, path: "pv1", wantErr: true},
+		{name: "unrelated absolute", storagePath: storagePath, path: "/etc/passwd", wantErr: true},
+		{name: "symlink", storagePath: storagePath, path: filepath.Join(storagePath, "escape"), wantErr: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := confinePath(test.storagePath, test.path)
+			if test.wantErr && err == nil {
+				t.Errorf("confinePath(%q, %q) succeeded, want error", test.storagePath, test.path)
+			}
+			if !test.wantErr && err != nil {
+				t.Errorf("confinePath(%q, %q) failed: %v", test.storagePath, test.path, err)
+			}
+		})
+	}
+}
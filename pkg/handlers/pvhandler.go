@@ -35,11 +35,11 @@ func NewPvHandler(storagePath string, cfg *rest.Config) (*PvHandler, error) {
 		storagePath: storagePath,
 		k8sClient:   kubeClient,
 	}
-	lvCap, err := lvmAvailableCapacity(storagePath)
+	lvCap, lvTotal, err := lvmCapacity(storagePath)
 	if err != nil {
 		return nil, err
 	}
-	err = createLVCapacityResource(nodeName, lvCap, kubeClient)
+	err = createLVCapacityResource(nodeName, lvCap, lvTotal, kubeClient)
 	return &pvHandler, err
 }
 
@@ -72,7 +72,14 @@ func (pvHandler *PvHandler) pvDeleted(pv v1.PersistentVolume) {
 	if pv.Spec.PersistentVolumeReclaimPolicy != v1.PersistentVolumeReclaimDelete {
 		return
 	}
+	if pv.Spec.Local == nil {
+		return
+	}
 	localVolumePath := pv.Spec.Local.Path
+	if err := confinePath(pvHandler.storagePath, localVolumePath); err != nil {
+		log.Println("PvHandler ERROR: Refusing to delete pv " + pv.ObjectMeta.Name + ", because: " + err.Error())
+		return
+	}
 	// delete directory
 	err := os.RemoveAll(localVolumePath)
 	if err != nil {
@@ -129,13 +136,14 @@ func (pvHandler *PvHandler) decreaseStorageCap(pv v1.PersistentVolume) error {
 	return nil
 }
 
-func createLVCapacityResource(nodeName string, lvCapacity int64, kubeClient kubernetes.Interface) error {
+func createLVCapacityResource(nodeName string, lvCapacity int64, lvTotalCapacity int64, kubeClient kubernetes.Interface) error {
 	node, err := k8sclient.GetNode(nodeName)
 	if err != nil {
 		return errors.New("Cannot get node(" + nodeName + "), because: " + err.Error())
 	}
 	lvCapQuantity := resource.NewQuantity(lvCapacity, resource.BinarySI)
 	node.Status.Capacity[k8sclient.LvCapacity] = *lvCapQuantity
+	node.Status.Capacity[k8sclient.LvTotalCapacity] = *resource.NewQuantity(lvTotalCapacity, resource.BinarySI)
 	err = k8sclient.UpdateNodeStatus(nodeName, node)
 	if err != nil {
 		return errors.New("Cannot update node(" + nodeName + "), because: " + err.Error())
@@ -143,11 +151,12 @@ func createLVCapacityResource(nodeName string, lvCapacity int64, kubeClient kube
 	return nil
 }
 
-func lvmAvailableCapacity(lvPath string) (int64, error) {
+// lvmCapacity returns the available and the total size of the filesystem
+func lvmCapacity(lvPath string) (int64, int64, error) {
 	fs := syscall.Statfs_t{}
 	err := syscall.Statfs(lvPath, &fs)
 	if err != nil {
-		return 0, errors.New("Cannot get FS info from: " + lvPath + " because: " + err.Error())
+		return 0, 0, errors.New("Cannot get FS info from: " + lvPath + " because: " + err.Error())
 	}
-	return int64(fs.Bavail) * fs.Bsize, nil
+	return int64(fs.Bavail) * fs.Bsize, int64(fs.Blocks) * fs.Bsize, nil
 }
@@ -0,0 +1,60 @@
+package health
+
+import (
+	"errors"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+
+	"k8s.io/client-go/tools/cache"
+)
+
+type Check func() error
+
+var (
+	lock            sync.RWMutex
+	readinessChecks = make(map[string]Check)
+)
+
+func AddReadinessCheck(name string, check Check) {
+	lock.Lock()
+	defer lock.Unlock()
+	readinessChecks[name] = check
+}
+
+func InformerSynced(synced cache.InformerSynced) Check {
+	return func() error {
+		if !synced() {
+			return errors.New("cache is not synced yet")
+		}
+		return nil
+	}
+}
+
+func ServeHealthz(w http.ResponseWriter, r *http.Request) {
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("ok"))
+}
+
+func ServeReadyz(w http.ResponseWriter, r *http.Request) {
+	lock.RLock()
+	names := make([]string, 0, len(readinessChecks))
+	for name := range readinessChecks {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	failures := []string{}
+	for _, name := range names {
+		if err := readinessChecks[name](); err != nil {
+			failures = append(failures, name+": "+err.Error())
+		}
+	}
+	lock.RUnlock()
+	if len(failures) > 0 {
+		http.Error(w, strings.Join(failures, "\n"), http.StatusServiceUnavailable)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("ok"))
+}
@@ -2,21 +2,55 @@ package k8sclient
 
 import (
 	"context"
+	"encoding/json"
 	"errors"
+	"log"
+	"strings"
+	"time"
 
-	"github.com/sbabiv/roundrobin"
+	admissionregistrationv1 "k8s.io/api/admissionregistration/v1"
+	authenticationv1 "k8s.io/api/authentication/v1"
+	authorizationv1 "k8s.io/api/authorization/v1"
 	v1 "k8s.io/api/core/v1"
+	storagev1 "k8s.io/api/storage/v1"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/informers"
 	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/scheme"
+	typedcorev1 "k8s.io/client-go/kubernetes/typed/core/v1"
 	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/tools/leaderelection"
+	"k8s.io/client-go/tools/leaderelection/resourcelock"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/client-go/util/retry"
 )
 
 const (
 	LvCapacity         = "nokia.k8s.io/lv-capacity"
+	LvTotalCapacity    = "nokia.k8s.io/lv-total-capacity"
 	LocalScProvisioner = "nokia.k8s.io/local"
 	NodeName           = "nokia.k8s.io/nodeName"
+	PvDirName          = "nokia.k8s.io/pvDirName"
 	RR                 = "round robin"
 	Cap                = "capacity"
+	BinPack            = "binpack"
+	LeastAllocated     = "least-allocated-ratio"
+)
+
+const (
+	// ProvisioningFailed is annotated onto the claims the executor of their node failed, with the time, the node
+	// and the reason, like "2021-06-01T12:00:00Z node-1: Not enough free space in storage!"
+	ProvisioningFailed = "nokia.k8s.io/provisioningFailed"
+	// FailedNodes lists the nodes which failed the earlier incarnations of a rescheduled claim
+	FailedNodes = "nokia.k8s.io/failedNodes"
+	// Maintenance set to "true" as a label or annotation stops new local volumes landing on the node
+	Maintenance = "nokia.k8s.io/local-storage-maintenance"
+	// LocalStorageReady is the node condition the executor publishes about its preflight checks
+	LocalStorageReady v1.NodeConditionType = "LocalStorageReady"
 )
 
 func getClientSet() (kubernetes.Interface, error) {
@@ -31,56 +65,128 @@ func getClientSet() (kubernetes.Interface, error) {
 	return clientset, nil
 }
 
-func GetAllNodes() (v1.NodeList, error) {
+func CheckConnectivity() error {
+	clientSet, err := getClientSet()
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.TODO(), 5*time.Second)
+	defer cancel()
+	return clientSet.Discovery().RESTClient().Get().AbsPath("/version").Do(ctx).Error()
+}
+
+func NewEventRecorder(component string) (record.EventRecorder, error) {
+	clientSet, err := getClientSet()
+	if err != nil {
+		return nil, err
+	}
+	broadcaster := record.NewBroadcaster()
+	broadcaster.StartRecordingToSink(&typedcorev1.EventSinkImpl{Interface: clientSet.CoreV1().Events("")})
+	return broadcaster.NewRecorder(scheme.Scheme, v1.EventSource{Component: component}), nil
+}
+
+func NewConfigMapInformer(namespace string, name string) (cache.SharedIndexInformer, error) {
+	clientSet, err := getClientSet()
+	if err != nil {
+		return nil, err
+	}
+	factory := informers.NewSharedInformerFactoryWithOptions(clientSet, 30*time.Second,
+		informers.WithNamespace(namespace),
+		informers.WithTweakListOptions(func(options *metav1.ListOptions) {
+			options.FieldSelector = fields.OneTermEqualSelector("metadata.name", name).String()
+		}))
+	return factory.Core().V1().ConfigMaps().Informer(), nil
+}
+
+func NewNodeInformer() (cache.SharedIndexInformer, error) {
+	clientSet, err := getClientSet()
+	if err != nil {
+		return nil, err
+	}
+	factory := informers.NewSharedInformerFactory(clientSet, 30*time.Second)
+	return factory.Core().V1().Nodes().Informer(), nil
+}
+
+func NewPvcInformer() (cache.SharedIndexInformer, error) {
 	clientSet, err := getClientSet()
 	if err != nil {
-		return v1.NodeList{}, err
+		return nil, err
+	}
+	factory := informers.NewSharedInformerFactory(clientSet, 30*time.Second)
+	return factory.Core().V1().PersistentVolumeClaims().Informer(), nil
+}
+
+func NewPvInformer() (cache.SharedIndexInformer, error) {
+	clientSet, err := getClientSet()
+	if err != nil {
+		return nil, err
 	}
-	nodes, err := clientSet.CoreV1().Nodes().List(context.TODO(), metav1.ListOptions{})
-	return *nodes, err
+	factory := informers.NewSharedInformerFactory(clientSet, 30*time.Second)
+	return factory.Core().V1().PersistentVolumes().Informer(), nil
 }
 
-func GetNodeByLabel(label string, selectorMethod string, rr *roundrobin.Balancer) (v1.Node, error) {
-	var (
-		returnNode  v1.Node
-		maxCapacity int64 = 0
-		listOption  metav1.ListOptions
-	)
+func NewLeaseInformer(namespace string, labelSelector string) (cache.SharedIndexInformer, error) {
 	clientSet, err := getClientSet()
 	if err != nil {
-		return v1.Node{}, err
+		return nil, err
 	}
-	listOption = metav1.ListOptions{LabelSelector: label}
-	nodeList, err := clientSet.CoreV1().Nodes().List(context.TODO(), listOption)
+	factory := informers.NewSharedInformerFactoryWithOptions(clientSet, 30*time.Second,
+		informers.WithNamespace(namespace),
+		informers.WithTweakListOptions(func(options *metav1.ListOptions) {
+			options.LabelSelector = labelSelector
+		}))
+	return factory.Coordination().V1().Leases().Informer(), nil
+}
+
+// PatchNodeLabels sets the labels of the node, the labels with nil value are removed
+func PatchNodeLabels(nodeName string, labels map[string]*string) error {
+	clientSet, err := getClientSet()
 	if err != nil {
-		return v1.Node{}, err
+		return err
 	}
-	switch nodesLen := len(nodeList.Items); nodesLen {
-	case 0:
-		return v1.Node{}, errors.New("No nodes found for label:" + label + "!")
-	case 1:
-		return nodeList.Items[0], nil
-	default:
-		if selectorMethod == RR {
-			nodeId, _ := rr.Pick()
-			returnNode = nodeList.Items[nodeId.(int)%len(nodeList.Items)]
-		} else if selectorMethod == Cap {
-			for _, node := range nodeList.Items {
-				nodeCapacity, ok := node.Status.Capacity[LvCapacity]
-				if !ok {
-					continue
-				}
-				if (&nodeCapacity).CmpInt64(maxCapacity) == 1 {
-					maxCapacity = (&nodeCapacity).Value()
-					returnNode = node
-				}
+	patch, err := json.Marshal(map[string]interface{}{"metadata": map[string]interface{}{"labels": labels}})
+	if err != nil {
+		return err
+	}
+	_, err = clientSet.CoreV1().Nodes().Patch(context.TODO(), nodeName, types.StrategicMergePatchType, patch, metav1.PatchOptions{})
+	return err
+}
+
+func NodeInMaintenance(node *v1.Node) bool {
+	return node.ObjectMeta.Labels[Maintenance] == "true" || node.ObjectMeta.Annotations[Maintenance] == "true"
+}
+
+// SetNodeCondition adds or replaces the condition of the node, keeping its transition time while the status does not change
+func SetNodeCondition(nodeName string, condition v1.NodeCondition) error {
+	return retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		node, err := GetNode(nodeName)
+		if err != nil {
+			return err
+		}
+		condition.LastTransitionTime = condition.LastHeartbeatTime
+		for i, existing := range node.Status.Conditions {
+			if existing.Type != condition.Type {
+				continue
+			}
+			if existing.Status == condition.Status {
+				condition.LastTransitionTime = existing.LastTransitionTime
 			}
+			node.Status.Conditions[i] = condition
+			return UpdateNodeStatus(nodeName, node)
+		}
+		node.Status.Conditions = append(node.Status.Conditions, condition)
+		return UpdateNodeStatus(nodeName, node)
+	})
+}
+
+// NodeConditionIsTrue tells whether the node has the condition with True status
+func NodeConditionIsTrue(node *v1.Node, conditionType v1.NodeConditionType) bool {
+	for _, condition := range node.Status.Conditions {
+		if condition.Type == conditionType {
+			return condition.Status == v1.ConditionTrue
 		}
 	}
-	if returnNode.ObjectMeta.Name == "" {
-		return v1.Node{}, errors.New("No lv-capacity set, yet!")
-	}
-	return returnNode, nil
+	return false
 }
 
 func UpdateNodeStatus(nodeName string, node *v1.Node) error {
@@ -96,16 +202,19 @@ func UpdateNodeStatus(nodeName string, node *v1.Node) error {
 }
 
 func StorageClassIsNokiaLocal(storageClassName string) (bool, error) {
-	clientSet, err := getClientSet()
+	storageClass, err := GetStorageClass(storageClassName)
 	if err != nil {
 		return false, err
 	}
+	return storageClass.Provisioner == LocalScProvisioner, nil
+}
 
-	storageClass, err := clientSet.StorageV1().StorageClasses().Get(context.TODO(), storageClassName, metav1.GetOptions{})
+func GetStorageClass(storageClassName string) (*storagev1.StorageClass, error) {
+	clientSet, err := getClientSet()
 	if err != nil {
-		return false, err
+		return nil, err
 	}
-	return storageClass.Provisioner == LocalScProvisioner, nil
+	return clientSet.StorageV1().StorageClasses().Get(context.TODO(), storageClassName, metav1.GetOptions{})
 }
 
 func GetNode(nodeName string) (*v1.Node, error) {
@@ -120,6 +229,101 @@ func GetNode(nodeName string) (*v1.Node, error) {
 	return node, nil
 }
 
+func GetNamespace(namespace string) (*v1.Namespace, error) {
+	clientSet, err := getClientSet()
+	if err != nil {
+		return nil, err
+	}
+	return clientSet.CoreV1().Namespaces().Get(context.TODO(), namespace, metav1.GetOptions{})
+}
+
+func GetPvc(namespace string, pvcName string) (*v1.PersistentVolumeClaim, error) {
+	clientSet, err := getClientSet()
+	if err != nil {
+		return nil, err
+	}
+	return clientSet.CoreV1().PersistentVolumeClaims(namespace).Get(context.TODO(), pvcName, metav1.GetOptions{})
+}
+
+// MarkProvisioningFailed annotates the claim with the time and the node which failed to provision it
+func MarkProvisioningFailed(namespace string, pvcName string, nodeName string, reason string) error {
+	clientSet, err := getClientSet()
+	if err != nil {
+		return err
+	}
+	failure := time.Now().UTC().Format(time.RFC3339) + " " + nodeName + ": " + reason
+	patch, err := json.Marshal(map[string]interface{}{"metadata": map[string]interface{}{"annotations": map[string]string{ProvisioningFailed: failure}}})
+	if err != nil {
+		return err
+	}
+	_, err = clientSet.CoreV1().PersistentVolumeClaims(namespace).Patch(context.TODO(), pvcName, types.MergePatchType, patch, metav1.PatchOptions{})
+	return err
+}
+
+// ProvisioningFailure returns when and why the node of the claim failed it. The time is zero when the annotation
+// was set without it.
+func ProvisioningFailure(pvc *v1.PersistentVolumeClaim) (time.Time, string, bool) {
+	failure, ok := pvc.ObjectMeta.Annotations[ProvisioningFailed]
+	if !ok {
+		return time.Time{}, "", false
+	}
+	parts := strings.SplitN(failure, " ", 2)
+	if len(parts) == 2 {
+		if failedAt, err := time.Parse(time.RFC3339, parts[0]); err == nil {
+			return failedAt, parts[1], true
+		}
+	}
+	return time.Time{}, failure, true
+}
+
+func CreatePvc(pvc *v1.PersistentVolumeClaim) error {
+	clientSet, err := getClientSet()
+	if err != nil {
+		return err
+	}
+	_, err = clientSet.CoreV1().PersistentVolumeClaims(pvc.ObjectMeta.Namespace).Create(context.TODO(), pvc, metav1.CreateOptions{})
+	return err
+}
+
+// DeletePvc deletes the claim only if it is still the same object
+func DeletePvc(pvc *v1.PersistentVolumeClaim) error {
+	clientSet, err := getClientSet()
+	if err != nil {
+		return err
+	}
+	return clientSet.CoreV1().PersistentVolumeClaims(pvc.ObjectMeta.Namespace).Delete(context.TODO(), pvc.ObjectMeta.Name,
+		metav1.DeleteOptions{Preconditions: &metav1.Preconditions{UID: &pvc.ObjectMeta.UID}})
+}
+
+// RunLeaderElection calls run once this replica is elected the leader of the Lease, and exits when the leadership is lost
+func RunLeaderElection(namespace string, name string, identity string, run func(stopCh <-chan struct{})) error {
+	clientSet, err := getClientSet()
+	if err != nil {
+		return err
+	}
+	lock := &resourcelock.LeaseLock{
+		LeaseMeta:  metav1.ObjectMeta{Namespace: namespace, Name: name},
+		Client:     clientSet.CoordinationV1(),
+		LockConfig: resourcelock.ResourceLockConfig{Identity: identity},
+	}
+	go leaderelection.RunOrDie(context.Background(), leaderelection.LeaderElectionConfig{
+		Lock:            lock,
+		ReleaseOnCancel: true,
+		LeaseDuration:   15 * time.Second,
+		RenewDeadline:   10 * time.Second,
+		RetryPeriod:     2 * time.Second,
+		Callbacks: leaderelection.LeaderCallbacks{
+			OnStartedLeading: func(ctx context.Context) {
+				run(ctx.Done())
+			},
+			OnStoppedLeading: func() {
+				log.Fatalln("ERROR: Leadership of Lease " + namespace + "/" + name + " is lost, exiting")
+			},
+		},
+	})
+	return nil
+}
+
 func GetVolume(pvName string) (*v1.PersistentVolume, error) {
 	clientSet, err := getClientSet()
 	if err != nil {
@@ -127,3 +331,202 @@ func GetVolume(pvName string) (*v1.PersistentVolume, error) {
 	}
 	return clientSet.CoreV1().PersistentVolumes().Get(context.TODO(), pvName, metav1.GetOptions{})
 }
+
+func GetConfigMap(namespace string, name string) (*v1.ConfigMap, error) {
+	clientSet, err := getClientSet()
+	if err != nil {
+		return nil, err
+	}
+	return clientSet.CoreV1().ConfigMaps(namespace).Get(context.TODO(), name, metav1.GetOptions{})
+}
+
+func CreateConfigMap(configMap *v1.ConfigMap) error {
+	clientSet, err := getClientSet()
+	if err != nil {
+		return err
+	}
+	_, err = clientSet.CoreV1().ConfigMaps(configMap.ObjectMeta.Namespace).Create(context.TODO(), configMap, metav1.CreateOptions{})
+	return err
+}
+
+func UpdateConfigMap(configMap *v1.ConfigMap) error {
+	clientSet, err := getClientSet()
+	if err != nil {
+		return err
+	}
+	_, err = clientSet.CoreV1().ConfigMaps(configMap.ObjectMeta.Namespace).Update(context.TODO(), configMap, metav1.UpdateOptions{})
+	return err
+}
+
+func GetSecret(namespace string, secretName string) (*v1.Secret, error) {
+	clientSet, err := getClientSet()
+	if err != nil {
+		return nil, err
+	}
+	secret, err := clientSet.CoreV1().Secrets(namespace).Get(context.TODO(), secretName, metav1.GetOptions{})
+	if err != nil {
+		return nil, err
+	}
+	return secret, nil
+}
+
+func CreateSecret(secret *v1.Secret) error {
+	clientSet, err := getClientSet()
+	if err != nil {
+		return err
+	}
+	_, err = clientSet.CoreV1().Secrets(secret.ObjectMeta.Namespace).Create(context.TODO(), secret, metav1.CreateOptions{})
+	return err
+}
+
+func UpdateSecret(secret *v1.Secret) error {
+	clientSet, err := getClientSet()
+	if err != nil {
+		return err
+	}
+	_, err = clientSet.CoreV1().Secrets(secret.ObjectMeta.Namespace).Update(context.TODO(), secret, metav1.UpdateOptions{})
+	return err
+}
+
+// PatchWebhookCABundle sets the caBundle of every webhook in the Mutating- and ValidatingWebhookConfiguration with the given name
+func PatchWebhookCABundle(configName string, caBundle []byte) error {
+	clientSet, err := getClientSet()
+	if err != nil {
+		return err
+	}
+	found := false
+	mutatingConfig, err := clientSet.AdmissionregistrationV1().MutatingWebhookConfigurations().Get(context.TODO(), configName, metav1.GetOptions{})
+	if err == nil {
+		found = true
+		for i := range mutatingConfig.Webhooks {
+			mutatingConfig.Webhooks[i].ClientConfig.CABundle = caBundle
+		}
+		if _, err = clientSet.AdmissionregistrationV1().MutatingWebhookConfigurations().Update(context.TODO(), mutatingConfig, metav1.UpdateOptions{}); err != nil {
+			return err
+		}
+	} else if !k8serrors.IsNotFound(err) {
+		return err
+	}
+	validatingConfig, err := clientSet.AdmissionregistrationV1().ValidatingWebhookConfigurations().Get(context.TODO(), configName, metav1.GetOptions{})
+	if err == nil {
+		found = true
+		for i := range validatingConfig.Webhooks {
+			validatingConfig.Webhooks[i].ClientConfig.CABundle = caBundle
+		}
+		if _, err = clientSet.AdmissionregistrationV1().ValidatingWebhookConfigurations().Update(context.TODO(), validatingConfig, metav1.UpdateOptions{}); err != nil {
+			return err
+		}
+	} else if !k8serrors.IsNotFound(err) {
+		return err
+	}
+	if !found {
+		return errors.New("No webhook configuration found with name " + configName)
+	}
+	return nil
+}
+
+// ApplyMutatingWebhookConfiguration creates the configuration, or updates it keeping the caBundle when the new one has none
+func ApplyMutatingWebhookConfiguration(config *admissionregistrationv1.MutatingWebhookConfiguration) error {
+	clientSet, err := getClientSet()
+	if err != nil {
+		return err
+	}
+	client := clientSet.AdmissionregistrationV1().MutatingWebhookConfigurations()
+	existing, err := client.Get(context.TODO(), config.ObjectMeta.Name, metav1.GetOptions{})
+	if k8serrors.IsNotFound(err) {
+		_, err = client.Create(context.TODO(), config, metav1.CreateOptions{})
+		return err
+	}
+	if err != nil {
+		return err
+	}
+	for i := range config.Webhooks {
+		if len(config.Webhooks[i].ClientConfig.CABundle) == 0 && i < len(existing.Webhooks) {
+			config.Webhooks[i].ClientConfig.CABundle = existing.Webhooks[i].ClientConfig.CABundle
+		}
+	}
+	config.ObjectMeta.ResourceVersion = existing.ObjectMeta.ResourceVersion
+	_, err = client.Update(context.TODO(), config, metav1.UpdateOptions{})
+	return err
+}
+
+// ApplyValidatingWebhookConfiguration creates the configuration, or updates it keeping the caBundle when the new one has none
+func ApplyValidatingWebhookConfiguration(config *admissionregistrationv1.ValidatingWebhookConfiguration) error {
+	clientSet, err := getClientSet()
+	if err != nil {
+		return err
+	}
+	client := clientSet.AdmissionregistrationV1().ValidatingWebhookConfigurations()
+	existing, err := client.Get(context.TODO(), config.ObjectMeta.Name, metav1.GetOptions{})
+	if k8serrors.IsNotFound(err) {
+		_, err = client.Create(context.TODO(), config, metav1.CreateOptions{})
+		return err
+	}
+	if err != nil {
+		return err
+	}
+	// Every webhook is served with the same certificate, so a webhook added since inherits the caBundle of the others
+	for i := range config.Webhooks {
+		if len(config.Webhooks[i].ClientConfig.CABundle) != 0 || len(existing.Webhooks) == 0 {
+			continue
+		}
+		config.Webhooks[i].ClientConfig.CABundle = existing.Webhooks[0].ClientConfig.CABundle
+		for _, webhook := range existing.Webhooks {
+			if webhook.Name == config.Webhooks[i].Name {
+				config.Webhooks[i].ClientConfig.CABundle = webhook.ClientConfig.CABundle
+			}
+		}
+	}
+	config.ObjectMeta.ResourceVersion = existing.ObjectMeta.ResourceVersion
+	_, err = client.Update(context.TODO(), config, metav1.UpdateOptions{})
+	return err
+}
+
+func DeleteMutatingWebhookConfiguration(configName string) error {
+	clientSet, err := getClientSet()
+	if err != nil {
+		return err
+	}
+	err = clientSet.AdmissionregistrationV1().MutatingWebhookConfigurations().Delete(context.TODO(), configName, metav1.DeleteOptions{})
+	if k8serrors.IsNotFound(err) {
+		return nil
+	}
+	return err
+}
+
+func DeleteValidatingWebhookConfiguration(configName string) error {
+	clientSet, err := getClientSet()
+	if err != nil {
+		return err
+	}
+	err = clientSet.AdmissionregistrationV1().ValidatingWebhookConfigurations().Delete(context.TODO(), configName, metav1.DeleteOptions{})
+	if k8serrors.IsNotFound(err) {
+		return nil
+	}
+	return err
+}
+
+func UserIsAllowed(userInfo authenticationv1.UserInfo, attributes authorizationv1.ResourceAttributes) (bool, error) {
+	clientSet, err := getClientSet()
+	if err != nil {
+		return false, err
+	}
+	extra := make(map[string]authorizationv1.ExtraValue, len(userInfo.Extra))
+	for key, value := range userInfo.Extra {
+		extra[key] = authorizationv1.ExtraValue(value)
+	}
+	review := &authorizationv1.SubjectAccessReview{
+		Spec: authorizationv1.SubjectAccessReviewSpec{
+			ResourceAttributes: &attributes,
+			User:               userInfo.Username,
+			Groups:             userInfo.Groups,
+			UID:                userInfo.UID,
+			Extra:              extra,
+		},
+	}
+	review, err = clientSet.AuthorizationV1().SubjectAccessReviews().Create(context.TODO(), review, metav1.CreateOptions{})
+	if err != nil {
+		return false, err
+	}
+	return review.Status.Allowed, nil
+}
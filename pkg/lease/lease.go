@@ -0,0 +1,129 @@
+package lease
+
+import (
+	"context"
+	"errors"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/nokia/dynamic-local-pv-provisioner/pkg/k8sclient"
+	coordinationv1 "k8s.io/api/coordination/v1"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/kubernetes"
+)
+
+const (
+	// DefaultNamespace holds nothing but the executor Leases, so the executors may write Leases only there
+	DefaultNamespace = "dynamic-local-pv-leases"
+	// NamePrefix is followed by the name of the node in the name of the executor Lease
+	NamePrefix = "dlpp-executor-"
+	// ComponentLabel marks the executor Leases, so the webhook can watch only them
+	ComponentLabel = "app.kubernetes.io/component"
+	Component      = "dlpp-executor"
+
+	VersionAnnotation      = "nokia.k8s.io/executor-version"
+	BackendAnnotation      = "nokia.k8s.io/storage-backend"
+	StoragePathsAnnotation = "nokia.k8s.io/storage-paths"
+	// MaintenanceAnnotation tells whether the executor refuses new volumes, because its node is in maintenance
+	MaintenanceAnnotation = "nokia.k8s.io/maintenance"
+
+	// Backend is the storage backend of the executor, directories with XFS project quotas
+	Backend = "xfs-prjquota"
+)
+
+// Version is set at build time with -ldflags "-X github.com/nokia/dynamic-local-pv-provisioner/pkg/lease.Version=..."
+var Version = "dev"
+
+// Metadata is published on the Lease of the executor
+type Metadata struct {
+	StoragePaths []string
+}
+
+// Renewer keeps the Lease of the executor of a node fresh, while the executor runs
+type Renewer struct {
+	client    kubernetes.Interface
+	namespace string
+	nodeName  string
+	duration  time.Duration
+	metadata  Metadata
+}
+
+func NewRenewer(client kubernetes.Interface, namespace string, nodeName string, duration time.Duration, metadata Metadata) (*Renewer, error) {
+	if nodeName == "" {
+		return nil, errors.New("Cannot renew the executor Lease without the name of the node")
+	}
+	return &Renewer{client: client, namespace: namespace, nodeName: nodeName, duration: duration, metadata: metadata}, nil
+}
+
+func Name(nodeName string) string {
+	return NamePrefix + nodeName
+}
+
+// Run renews the Lease three times per lease duration until the stop channel is closed
+func (renewer *Renewer) Run(stopCh <-chan struct{}) {
+	wait.Until(func() {
+		if err := renewer.renew(); err != nil {
+			log.Println("ERROR: Cannot renew executor Lease " + renewer.namespace + "/" + Name(renewer.nodeName) + ", because: " + err.Error())
+		}
+	}, renewer.duration/3, stopCh)
+}
+
+func (renewer *Renewer) renew() error {
+	leases := renewer.client.CoordinationV1().Leases(renewer.namespace)
+	existing, err := leases.Get(context.TODO(), Name(renewer.nodeName), metav1.GetOptions{})
+	if k8serrors.IsNotFound(err) {
+		_, err = leases.Create(context.TODO(), renewer.apply(&coordinationv1.Lease{}), metav1.CreateOptions{})
+		return err
+	}
+	if err != nil {
+		return err
+	}
+	_, err = leases.Update(context.TODO(), renewer.apply(existing.DeepCopy()), metav1.UpdateOptions{})
+	return err
+}
+
+func (renewer *Renewer) inMaintenance() bool {
+	node, err := renewer.client.CoreV1().Nodes().Get(context.TODO(), renewer.nodeName, metav1.GetOptions{})
+	if err != nil {
+		log.Println("ERROR: Cannot get node " + renewer.nodeName + " for its maintenance state, because: " + err.Error())
+		return false
+	}
+	return k8sclient.NodeInMaintenance(node)
+}
+
+func (renewer *Renewer) apply(lease *coordinationv1.Lease) *coordinationv1.Lease {
+	durationSeconds := int32(renewer.duration.Seconds())
+	now := metav1.NewMicroTime(time.Now())
+	lease.ObjectMeta.Name = Name(renewer.nodeName)
+	lease.ObjectMeta.Namespace = renewer.namespace
+	if lease.ObjectMeta.Labels == nil {
+		lease.ObjectMeta.Labels = make(map[string]string)
+	}
+	lease.ObjectMeta.Labels[ComponentLabel] = Component
+	if lease.ObjectMeta.Annotations == nil {
+		lease.ObjectMeta.Annotations = make(map[string]string)
+	}
+	lease.ObjectMeta.Annotations[VersionAnnotation] = Version
+	lease.ObjectMeta.Annotations[BackendAnnotation] = Backend
+	lease.ObjectMeta.Annotations[StoragePathsAnnotation] = strings.Join(renewer.metadata.StoragePaths, ",")
+	lease.ObjectMeta.Annotations[MaintenanceAnnotation] = strconv.FormatBool(renewer.inMaintenance())
+	lease.Spec.HolderIdentity = &renewer.nodeName
+	lease.Spec.LeaseDurationSeconds = &durationSeconds
+	if lease.Spec.AcquireTime == nil {
+		lease.Spec.AcquireTime = &now
+	}
+	lease.Spec.RenewTime = &now
+	return lease
+}
+
+// IsFresh tells whether the holder renewed the Lease within its duration
+func IsFresh(lease *coordinationv1.Lease, now time.Time) bool {
+	if lease.Spec.RenewTime == nil || lease.Spec.LeaseDurationSeconds == nil {
+		return false
+	}
+	return lease.Spec.RenewTime.Add(time.Duration(*lease.Spec.LeaseDurationSeconds) * time.Second).After(now)
+}
@@ -0,0 +1,55 @@
+package lease
+
+import (
+	"errors"
+	"time"
+
+	"github.com/nokia/dynamic-local-pv-provisioner/pkg/k8sclient"
+	coordinationv1 "k8s.io/api/coordination/v1"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/client-go/tools/cache"
+)
+
+// Tracker follows the executor Leases, so only the nodes with a running executor are selected
+type Tracker struct {
+	namespace string
+	informer  cache.SharedIndexInformer
+}
+
+func NewTracker(namespace string) (*Tracker, error) {
+	informer, err := k8sclient.NewLeaseInformer(namespace, ComponentLabel+"="+Component)
+	if err != nil {
+		return nil, err
+	}
+	return &Tracker{namespace: namespace, informer: informer}, nil
+}
+
+func (tracker *Tracker) Run(stopCh <-chan struct{}) {
+	tracker.informer.Run(stopCh)
+}
+
+func (tracker *Tracker) HasSynced() bool {
+	return tracker.informer.HasSynced()
+}
+
+// Get returns the Lease of the executor of the node, or nil when it has none
+func (tracker *Tracker) Get(nodeName string) *coordinationv1.Lease {
+	obj, exists, err := tracker.informer.GetStore().GetByKey(tracker.namespace + "/" + Name(nodeName))
+	if err != nil || !exists {
+		return nil
+	}
+	lease, _ := obj.(*coordinationv1.Lease)
+	return lease
+}
+
+// ExecutorIsAlive rejects the nodes whose executor has no fresh Lease
+func (tracker *Tracker) ExecutorIsAlive(node *v1.Node) error {
+	lease := tracker.Get(node.ObjectMeta.Name)
+	if lease == nil {
+		return errors.New("Node has no executor Lease")
+	}
+	if !IsFresh(lease, time.Now()) {
+		return errors.New("Executor Lease of the node is expired")
+	}
+	return nil
+}
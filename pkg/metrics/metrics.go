@@ -0,0 +1,81 @@
+package metrics
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	namespace = "dlpp"
+	subsystem = "webhook"
+)
+
+var (
+	AdmissionDuration = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "admission_duration_seconds",
+			Help:      "Latency of admission requests served by the webhook.",
+			Buckets:   prometheus.DefBuckets,
+		},
+		[]string{"webhook", "allowed"},
+	)
+	PlacementDecisions = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "placement_decisions_total",
+			Help:      "Number of local PVCs placed on each node.",
+		},
+		[]string{"node", "method"},
+	)
+	ConfigReloads = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "config_reloads_total",
+			Help:      "Number of configuration revisions applied or rejected.",
+		},
+		[]string{"result"},
+	)
+	DryRunPlacements = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "dry_run_placements_total",
+			Help:      "Number of local PVCs the webhook would have placed on each node in dry-run mode.",
+		},
+		[]string{"node", "method"},
+	)
+	DryRunDecisions = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "dry_run_decisions_total",
+			Help:      "Number of admission requests the webhook allowed in dry-run mode, by what it would have done.",
+		},
+		[]string{"webhook", "decision"},
+	)
+	Reschedules = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "reschedules_total",
+			Help:      "Number of local PVCs recreated, because their node could not provision them.",
+		},
+		[]string{"result"},
+	)
+	AdmissionErrors = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "admission_errors_total",
+			Help:      "Number of admission requests the webhook failed or rejected, by reason.",
+		},
+		[]string{"webhook", "reason"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(AdmissionDuration, PlacementDecisions, AdmissionErrors, ConfigReloads, Reschedules, DryRunPlacements, DryRunDecisions)
+}
@@ -0,0 +1,171 @@
+package mutator
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/nokia/dynamic-local-pv-provisioner/pkg/metrics"
+	admissionv1 "k8s.io/api/admission/v1"
+	"k8s.io/api/admission/v1beta1"
+	"k8s.io/apimachinery/pkg/runtime"
+	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
+)
+
+const (
+	mutatingWebhook   = "mutating"
+	validatingWebhook = "validating"
+)
+
+// admitFunc handles the version independent content of an AdmissionReview
+type admitFunc func(admissionv1.AdmissionReview) *admissionv1.AdmissionResponse
+
+func init() {
+	utilruntime.Must(admissionv1.AddToScheme(scheme))
+	utilruntime.Must(v1beta1.AddToScheme(scheme))
+}
+
+// serve decodes an admission.k8s.io/v1 or v1beta1 AdmissionReview and answers in the version it was received
+func serve(w http.ResponseWriter, r *http.Request, webhook string, admit admitFunc) {
+	start := time.Now()
+	var body []byte
+	if r.Body != nil {
+		if data, err := ioutil.ReadAll(r.Body); err == nil {
+			body = data
+		}
+	}
+	// verify the content type is accurate
+	contentType := r.Header.Get("Content-Type")
+	if contentType != "application/json" {
+		log.Printf("ERROR: contentType=%s, expect application/json\n", contentType)
+		return
+	}
+
+	deserializer := codecs.UniversalDeserializer()
+	obj, gvk, err := deserializer.Decode(body, nil, nil)
+	if err != nil {
+		log.Println("ERROR: Decode AdmissionReview is failed, because " + err.Error())
+		metrics.AdmissionErrors.WithLabelValues(webhook, "decode").Inc()
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var (
+		responseObj runtime.Object
+		allowed     bool
+	)
+	switch *gvk {
+	case v1beta1.SchemeGroupVersion.WithKind("AdmissionReview"):
+		requestedAdmissionReview, ok := obj.(*v1beta1.AdmissionReview)
+		if !ok || requestedAdmissionReview.Request == nil {
+			log.Println("ERROR: AdmissionReview " + gvk.String() + " has no request")
+			http.Error(w, "AdmissionReview has no request", http.StatusBadRequest)
+			return
+		}
+		responseAdmissionReview := &v1beta1.AdmissionReview{}
+		responseAdmissionReview.SetGroupVersionKind(*gvk)
+		responseAdmissionReview.Response = responseToV1beta1(admit(reviewToV1(*requestedAdmissionReview)))
+		responseAdmissionReview.Response.UID = requestedAdmissionReview.Request.UID
+		allowed = responseAdmissionReview.Response.Allowed
+		responseObj = responseAdmissionReview
+	case admissionv1.SchemeGroupVersion.WithKind("AdmissionReview"):
+		requestedAdmissionReview, ok := obj.(*admissionv1.AdmissionReview)
+		if !ok || requestedAdmissionReview.Request == nil {
+			log.Println("ERROR: AdmissionReview " + gvk.String() + " has no request")
+			http.Error(w, "AdmissionReview has no request", http.StatusBadRequest)
+			return
+		}
+		responseAdmissionReview := &admissionv1.AdmissionReview{}
+		responseAdmissionReview.SetGroupVersionKind(*gvk)
+		responseAdmissionReview.Response = admit(*requestedAdmissionReview)
+		responseAdmissionReview.Response.UID = requestedAdmissionReview.Request.UID
+		allowed = responseAdmissionReview.Response.Allowed
+		responseObj = responseAdmissionReview
+	default:
+		err = errors.New("Unsupported group version kind: " + gvk.String())
+		log.Println("ERROR: " + err.Error())
+		metrics.AdmissionErrors.WithLabelValues(webhook, "unsupported_version").Inc()
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	metrics.AdmissionDuration.WithLabelValues(webhook, strconv.FormatBool(allowed)).Observe(time.Since(start).Seconds())
+
+	respBytes, err := json.Marshal(responseObj)
+	if err != nil {
+		log.Println("ERROR: Marshal responseAdmissionReview is failed, because " + err.Error())
+	}
+	w.Header().Set("Content-Type", "application/json")
+
+	if _, err := w.Write(respBytes); err != nil {
+		log.Println("ERROR: Write response is failed, because " + err.Error())
+	}
+}
+
+func admissionError(webhook string, reason string, err error) *admissionv1.AdmissionResponse {
+	metrics.AdmissionErrors.WithLabelValues(webhook, reason).Inc()
+	return toAdmissionResponse(err)
+}
+
+func reviewToV1(review v1beta1.AdmissionReview) admissionv1.AdmissionReview {
+	request := review.Request
+	return admissionv1.AdmissionReview{
+		Request: &admissionv1.AdmissionRequest{
+			UID:                request.UID,
+			Kind:               request.Kind,
+			Resource:           request.Resource,
+			SubResource:        request.SubResource,
+			RequestKind:        request.RequestKind,
+			RequestResource:    request.RequestResource,
+			RequestSubResource: request.RequestSubResource,
+			Name:               request.Name,
+			Namespace:          request.Namespace,
+			Operation:          admissionv1.Operation(request.Operation),
+			UserInfo:           request.UserInfo,
+			Object:             request.Object,
+			OldObject:          request.OldObject,
+			DryRun:             request.DryRun,
+			Options:            request.Options,
+		},
+	}
+}
+
+func responseToV1beta1(response *admissionv1.AdmissionResponse) *v1beta1.AdmissionResponse {
+	var patchType *v1beta1.PatchType
+	if response.PatchType != nil {
+		pt := v1beta1.PatchType(*response.PatchType)
+		patchType = &pt
+	}
+	return &v1beta1.AdmissionResponse{
+		UID:              response.UID,
+		Allowed:          response.Allowed,
+		Result:           response.Result,
+		Patch:            response.Patch,
+		PatchType:        patchType,
+		AuditAnnotations: response.AuditAnnotations,
+		Warnings:         response.Warnings,
+	}
+}
+
+// shadow allows the request whatever the webhook decided in dry-run mode, only logging and counting the decision
+func shadow(webhook string, ar admissionv1.AdmissionReview, response *admissionv1.AdmissionResponse) *admissionv1.AdmissionResponse {
+	object := ar.Request.Namespace + "/" + ar.Request.Name
+	switch {
+	case !response.Allowed:
+		message := ""
+		if response.Result != nil {
+			message = response.Result.Message
+		}
+		log.Println("INFO: DRY-RUN " + webhook + " webhook would reject " + object + ": " + message)
+		metrics.DryRunDecisions.WithLabelValues(webhook, "rejected").Inc()
+	case len(response.Patch) > 0:
+		log.Println("INFO: DRY-RUN " + webhook + " webhook would patch " + object + " with " + string(response.Patch))
+		metrics.DryRunDecisions.WithLabelValues(webhook, "patched").Inc()
+	default:
+		metrics.DryRunDecisions.WithLabelValues(webhook, "allowed").Inc()
+	}
+	return &admissionv1.AdmissionResponse{Allowed: true}
+}
@@ -0,0 +1,77 @@
+package mutator
+
+import (
+	"encoding/json"
+	"errors"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/nokia/dynamic-local-pv-provisioner/pkg/k8sclient"
+	admissionv1 "k8s.io/api/admission/v1"
+	authorizationv1 "k8s.io/api/authorization/v1"
+	corev1 "k8s.io/api/core/v1"
+)
+
+// Users may set or change the internal annotations only in the pinning namespaces,
+// or when RBAC allows them to update the virtual persistentvolumeclaims/placement subresource
+const placementSubresource = "placement"
+
+var internalAnnotations = []string{k8sclient.NodeName, k8sclient.PvDirName}
+
+func (mutator *Mutator) authorizeInternalAnnotations(request *admissionv1.AdmissionRequest, namespace string) error {
+	if mutator.pinningNamespaces[namespace] {
+		return nil
+	}
+	allowed, err := k8sclient.UserIsAllowed(request.UserInfo, authorizationv1.ResourceAttributes{
+		Namespace:   namespace,
+		Verb:        "update",
+		Resource:    "persistentvolumeclaims",
+		Subresource: placementSubresource,
+	})
+	if err != nil {
+		return errors.New("Cannot authorize internal annotations, because: " + err.Error())
+	}
+	if !allowed {
+		return errors.New("User " + request.UserInfo.Username + " is not allowed to set " + k8sclient.NodeName + " or " + k8sclient.PvDirName + " in namespace " + namespace)
+	}
+	return nil
+}
+
+func changedInternalAnnotations(oldPvc corev1.PersistentVolumeClaim, newPvc corev1.PersistentVolumeClaim) bool {
+	for _, annotation := range internalAnnotations {
+		if oldPvc.ObjectMeta.Annotations[annotation] != newPvc.ObjectMeta.Annotations[annotation] {
+			return true
+		}
+	}
+	return false
+}
+
+// validatePvDirName makes sure the directory name cannot escape the storage path of the executor
+func validatePvDirName(pvDirName string) error {
+	if pvDirName == "" || pvDirName == "." || pvDirName == ".." || strings.ContainsRune(pvDirName, filepath.Separator) {
+		return errors.New(k8sclient.PvDirName + " " + pvDirName + " is not a valid directory name")
+	}
+	return nil
+}
+
+// addAnnotations patches the annotations one by one, so the existing ones are kept. Adding the whole map
+// would replace the group and colocation annotations the placement of the other claims relies on, so only
+// a claim without annotations gets it.
+func addAnnotations(pvc corev1.PersistentVolumeClaim, patchList []patch, annotations map[string]string) []patch {
+	if len(pvc.ObjectMeta.Annotations) == 0 {
+		value, _ := json.Marshal(annotations)
+		return append(patchList, patch{Op: "add", Path: "/metadata/annotations", Value: json.RawMessage(value)})
+	}
+	keys := make([]string, 0, len(annotations))
+	for key := range annotations {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		value, _ := json.Marshal(annotations[key])
+		path := "/metadata/annotations/" + strings.NewReplacer("~", "~0", "/", "~1").Replace(key)
+		patchList = append(patchList, patch{Op: "add", Path: path, Value: json.RawMessage(value)})
+	}
+	return patchList
+}
@@ -0,0 +1,93 @@
+package mutator
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/nokia/dynamic-local-pv-provisioner/pkg/nodeselector"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestValidatePvDirName(t *testing.T) {
+	tests := []struct {
+		pvDirName string
+		wantErr   bool
+	}{
+		{pvDirName: "pv1"},
+		{pvDirName: "my-volume.data"},
+		{pvDirName: "..data"},
+		{pvDirName: "", wantErr: true},
+		{pvDirName: ".", wantErr: true},
+		{pvDirName: "..", wantErr: true},
+		{pvDirName: "../etc", wantErr: true},
+		{pvDirName: "/etc", wantErr: true},
+		{pvDirName: "/", wantErr: true},
+		{pvDirName: "a/b", wantErr: true},
+		{pvDirName: "pv1/", wantErr: true},
+		{pvDirName: "a/../b", wantErr: true},
+	}
+	for _, test := range tests {
+		err := validatePvDirName(test.pvDirName)
+		if test.wantErr && err == nil {
+			t.Errorf("validatePvDirName(%q) succeeded, want error", test.pvDirName)
+		}
+		if !test.wantErr && err != nil {
+			t.Errorf("validatePvDirName(%q) failed: %v", test.pvDirName, err)
+		}
+	}
+}
+
+// applyAnnotationPatches applies the add operations on the annotations the way the API server does
+func applyAnnotationPatches(t *testing.T, annotations map[string]string, patchList []patch) map[string]string {
+	for _, item := range patchList {
+		if item.Op != "add" || !strings.HasPrefix(item.Path, "/metadata/annotations") {
+			t.Fatalf("unexpected patch %s %s", item.Op, item.Path)
+		}
+		if item.Path == "/metadata/annotations" {
+			annotations = make(map[string]string)
+			if err := json.Unmarshal(item.Value, &annotations); err != nil {
+				t.Fatal(err)
+			}
+			continue
+		}
+		key := strings.NewReplacer("~1", "/", "~0", "~").Replace(strings.TrimPrefix(item.Path, "/metadata/annotations/"))
+		var value string
+		if err := json.Unmarshal(item.Value, &value); err != nil {
+			t.Fatal(err)
+		}
+		annotations[key] = value
+	}
+	return annotations
+}
+
+func TestAddAnnotations(t *testing.T) {
+	added := map[string]string{nodeNameAnnotation: "node-1", nodeselector.ExplanationAnnotation: `{"node":"node-1"}`}
+	tests := []struct {
+		name        string
+		annotations map[string]string
+	}{
+		{name: "no annotations"},
+		{name: "group", annotations: map[string]string{nodeselector.GroupAnnotation: "db", nodeselector.GroupAntiAffinityAnnotation: "hard"}},
+		{name: "colocation", annotations: map[string]string{nodeselector.ColocationGroupAnnotation: "app", nodeselector.ColocateWithAnnotation: "data-0"}},
+		{name: "key with tilde", annotations: map[string]string{"example.com/a~b": "c"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			pvc := corev1.PersistentVolumeClaim{ObjectMeta: metav1.ObjectMeta{Annotations: test.annotations}}
+			existing := make(map[string]string)
+			for key, value := range test.annotations {
+				existing[key] = value
+			}
+			got := applyAnnotationPatches(t, existing, addAnnotations(pvc, nil, added))
+			for _, want := range []map[string]string{test.annotations, added} {
+				for key, value := range want {
+					if got[key] != value {
+						t.Errorf("annotation %s = %q, want %q", key, got[key], value)
+					}
+				}
+			}
+		})
+	}
+}
@@ -5,38 +5,36 @@ import (
 	"errors"
 	"fmt"
 	"hash/fnv"
-	"io/ioutil"
 	"log"
 	"math/rand"
 	"net/http"
 	"strings"
 	"time"
 
-	"github.com/go-yaml/yaml"
-	"k8s.io/api/admission/v1beta1"
+	admissionv1 "k8s.io/api/admission/v1"
 	corev1 "k8s.io/api/core/v1"
+	storagev1 "k8s.io/api/storage/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
 	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/runtime/serializer"
 
+	"github.com/nokia/dynamic-local-pv-provisioner/pkg/config"
 	"github.com/nokia/dynamic-local-pv-provisioner/pkg/k8sclient"
-	"github.com/sbabiv/roundrobin"
+	"github.com/nokia/dynamic-local-pv-provisioner/pkg/metrics"
+	"github.com/nokia/dynamic-local-pv-provisioner/pkg/nodeselector"
+	"github.com/nokia/dynamic-local-pv-provisioner/pkg/rescheduler"
 )
 
 const (
-	defaultSelectorFilePath = "/etc/config/config.yml"
-	nodeNameAnnotation      = "nokia.k8s.io/nodeName"
-	patchPvDirName          = "nokia.k8s.io~1pvDirName"
-	nodeSelector            = "nokia.k8s.io/nodeSelector"
+	nodeNameAnnotation = "nokia.k8s.io/nodeName"
+	patchPvDirName     = "nokia.k8s.io~1pvDirName"
+	nodeSelector       = "nokia.k8s.io/nodeSelector"
 )
 
 var (
-	scheme                = runtime.NewScheme()
-	codecs                = serializer.NewCodecFactory(scheme)
-	parsedDefaultSelector map[string]struct {
-		DefaultNodeSelector string `yaml:"defaultNodeSelector"`
-	}
-	nodeSelectMethod string
+	scheme = runtime.NewScheme()
+	codecs = serializer.NewCodecFactory(scheme)
 )
 
 type patch struct {
@@ -45,8 +43,8 @@ type patch struct {
 	Value json.RawMessage `json:"value"`
 }
 
-func toAdmissionResponse(err error) *v1beta1.AdmissionResponse {
-	return &v1beta1.AdmissionResponse{
+func toAdmissionResponse(err error) *admissionv1.AdmissionResponse {
+	return &admissionv1.AdmissionResponse{
 		Result: &metav1.Status{
 			Message: err.Error(),
 		},
@@ -55,111 +53,89 @@ func toAdmissionResponse(err error) *v1beta1.AdmissionResponse {
 }
 
 type Mutator struct {
-	rr        *roundrobin.Balancer
-	nodeLabel string
+	nodeSelectMethod  string
+	topologyKey       string
+	nodeLabel         labels.Selector
+	pinningNamespaces map[string]bool
+	config            *config.Store
+	nodes             *nodeselector.Nodes
+	claims            *nodeselector.Claims
+	volumes           *nodeselector.Volumes
+	reservations      *nodeselector.Reservations
+	nodeChecks        []nodeselector.NodeCheck
+	history           *rescheduler.History
+	// dryRun computes the placement and the patches, but allows every request unchanged
+	dryRun bool
 }
 
-func NewMutator(method string, nodeLabel string) (*Mutator, error) {
-	var nodeList []string
-	err := parseDefaultNodeSelector()
+func NewMutator(method string, topologyKey string, nodeLabel string, pinningNamespaces []string, configStore *config.Store, nodes *nodeselector.Nodes, claims *nodeselector.Claims, volumes *nodeselector.Volumes, reservations *nodeselector.Reservations) (*Mutator, error) {
+	labelSelector, err := config.ParseSelector(nodeLabel)
 	if err != nil {
-		log.Println("WARNING: Cannot parse default node selector, because: " + err.Error() + ". Continue without it...")
+		return nil, errors.New("Cannot parse node label " + nodeLabel + ", because: " + err.Error())
 	}
-	mutator := Mutator{rr: nil, nodeLabel: nodeLabel}
-	nodeSelectMethod = method
-	if nodeSelectMethod == k8sclient.RR {
-		nodes, err := k8sclient.GetAllNodes()
-		if err != nil {
-			return nil, errors.New("Cannot get list of all nodes, because: " + err.Error())
-		}
-		for _, node := range nodes.Items {
-			nodeList = append(nodeList, node.ObjectMeta.Name)
-		}
-		nodeIds := make([]interface{}, len(nodeList))
-		for i := 0; i < len(nodeList); i++ {
-			nodeIds[i] = i
-		}
-		mutator.rr = roundrobin.New(nodeIds)
+	if _, err = nodeselector.Get(method); err != nil {
+		return nil, err
+	}
+	mutator := Mutator{nodeSelectMethod: method, topologyKey: topologyKey, nodeLabel: labelSelector, pinningNamespaces: make(map[string]bool), config: configStore, nodes: nodes, claims: claims, volumes: volumes, reservations: reservations}
+	for _, namespace := range pinningNamespaces {
+		mutator.pinningNamespaces[namespace] = true
 	}
 	return &mutator, nil
 }
 
-func parseDefaultNodeSelector() error {
-	file, err := ioutil.ReadFile(defaultSelectorFilePath)
-	if err != nil {
-		return err
-	}
-	err = yaml.Unmarshal([]byte(file), &parsedDefaultSelector)
-	if err != nil {
-		return err
-	}
-	return nil
+// AddNodeCheck rejects the nodes failing the check at placement
+func (mutator *Mutator) AddNodeCheck(check nodeselector.NodeCheck) {
+	mutator.nodeChecks = append(mutator.nodeChecks, check)
 }
 
-func (mutator *Mutator) ServeMutatePvc(w http.ResponseWriter, r *http.Request) {
-	var body []byte
-	if r.Body != nil {
-		if data, err := ioutil.ReadAll(r.Body); err == nil {
-			body = data
-		}
-	}
-	// verify the content type is accurate
-	contentType := r.Header.Get("Content-Type")
-	if contentType != "application/json" {
-		log.Printf("ERROR: contentType=%s, expect application/json\n", contentType)
-		return
-	}
-	requestedAdmissionReview := v1beta1.AdmissionReview{}
-
-	responseAdmissionReview := v1beta1.AdmissionReview{}
-
-	deserializer := codecs.UniversalDeserializer()
-	if _, _, err := deserializer.Decode(body, nil, &requestedAdmissionReview); err != nil {
-		log.Println("ERROR: Decode Pvc body is failed, because " + err.Error())
-		responseAdmissionReview.Response = toAdmissionResponse(err)
-	} else {
-		responseAdmissionReview.Response = mutatePvcs(requestedAdmissionReview, mutator.rr, mutator.nodeLabel)
-	}
-	responseAdmissionReview.Response.UID = requestedAdmissionReview.Request.UID
+// SetHistory makes the placement avoid the nodes which failed the previous incarnations of a rescheduled claim
+func (mutator *Mutator) SetHistory(history *rescheduler.History) {
+	mutator.history = history
+}
 
-	respBytes, err := json.Marshal(responseAdmissionReview)
-	if err != nil {
-		log.Println("ERROR: Marshal responseAdmissionReview is failed, because " + err.Error())
-	}
-	w.Header().Set("Content-Type", "application/json")
+// SetDryRun makes the webhooks only log and count what they would have done. The placements are reserved in
+// the shadow reservations instead, so a burst of claims is spread as it would be for real.
+func (mutator *Mutator) SetDryRun(shadowReservations *nodeselector.Reservations) {
+	mutator.dryRun = true
+	mutator.reservations = shadowReservations
+}
 
-	if _, err := w.Write(respBytes); err != nil {
-		log.Println("ERROR: Write response is failed, because " + err.Error())
-	}
+func (mutator *Mutator) ServeMutatePvc(w http.ResponseWriter, r *http.Request) {
+	serve(w, r, mutatingWebhook, func(ar admissionv1.AdmissionReview) *admissionv1.AdmissionResponse {
+		if mutator.dryRun {
+			return shadow(mutatingWebhook, ar, mutator.mutatePvcs(ar))
+		}
+		return mutator.mutatePvcs(ar)
+	})
 }
 
-func mutatePvcs(ar v1beta1.AdmissionReview, rr *roundrobin.Balancer, nodeLabel string) *v1beta1.AdmissionResponse {
+func (mutator *Mutator) mutatePvcs(ar admissionv1.AdmissionReview) *admissionv1.AdmissionResponse {
 	var (
 		patchList []patch
 		err       error
 	)
-	raw := ar.Request.Object.Raw
-	pvc := corev1.PersistentVolumeClaim{}
-	deserializer := codecs.UniversalDeserializer()
-	if _, _, err = deserializer.Decode(raw, nil, &pvc); err != nil {
-		log.Println("ERROR: Decode Pvc body is failed, because " + err.Error())
-		return toAdmissionResponse(err)
+	pvc, err := decodePvc(ar.Request.Object.Raw)
+	if err != nil {
+		return admissionError(mutatingWebhook, "decode", err)
 	}
-	reviewResponse := v1beta1.AdmissionResponse{}
+	reviewResponse := admissionv1.AdmissionResponse{}
 	reviewResponse.Allowed = true
 
-	mutatePvc, err := k8sclient.StorageClassIsNokiaLocal(*(pvc.Spec.StorageClassName))
-	if !mutatePvc {
-		if err != nil {
-			log.Println("ERROR: Cannot check storageclass " + pvc.ObjectMeta.Name + " pvc, ID: " + string(pvc.ObjectMeta.UID) + ", because " + err.Error())
-		}
+	if !pvcIsLocal(pvc) {
 		return &reviewResponse
 	}
+	if pvc.ObjectMeta.Namespace == "" {
+		pvc.ObjectMeta.Namespace = ar.Request.Namespace
+	}
 	nodeAnnotation, nodeAnnotationExists := pvc.ObjectMeta.Annotations[k8sclient.NodeName]
-	if !nodeAnnotationExists {
-		patchList, nodeAnnotation, err = setNodeSelector(pvc, patchList, rr, nodeLabel)
+	if nodeAnnotationExists {
+		if err = mutator.authorizeInternalAnnotations(ar.Request, pvc.ObjectMeta.Namespace); err != nil {
+			return admissionError(mutatingWebhook, "unauthorized", err)
+		}
+	} else {
+		patchList, nodeAnnotation, err = mutator.setNodeSelector(pvc, patchList)
 		if err != nil {
-			return toAdmissionResponse(err)
+			return admissionError(mutatingWebhook, "placement", err)
 		}
 	}
 	patchList = patchVolumeNameAndPvDir(pvc, nodeAnnotation, patchList)
@@ -169,55 +145,211 @@ func mutatePvcs(ar v1beta1.AdmissionReview, rr *roundrobin.Balancer, nodeLabel s
 		if err != nil {
 			log.Printf("ERROR: Patch marshall error %v:%v\n", patchList, err)
 			reviewResponse.Allowed = false
-			return toAdmissionResponse(err)
+			return admissionError(mutatingWebhook, "patch", err)
 		}
 		reviewResponse.Patch = []byte(patch)
-		pt := v1beta1.PatchTypeJSONPatch
+		pt := admissionv1.PatchTypeJSONPatch
 		reviewResponse.PatchType = &pt
 	}
 
 	return &reviewResponse
 }
 
-func setNodeSelector(pvc corev1.PersistentVolumeClaim, patchList []patch, rr *roundrobin.Balancer, nodeLabel string) ([]patch, string, error) {
-	var patchItem patch
-	nodeSelectorMap := make(map[string]string)
-	if nodeSel, ok := pvc.ObjectMeta.Annotations[nodeSelector]; ok {
-		if nodeSel != "" {
-			err := json.Unmarshal([]byte(nodeSel), &nodeSelectorMap)
-			if err != nil {
-				return patchList, "", errors.New("ERROR: Cannot parse nodeselector " + nodeSel + " because: " + err.Error())
-			}
-		}
+func decodePvc(raw []byte) (corev1.PersistentVolumeClaim, error) {
+	pvc := corev1.PersistentVolumeClaim{}
+	deserializer := codecs.UniversalDeserializer()
+	if _, _, err := deserializer.Decode(raw, nil, &pvc); err != nil {
+		log.Println("ERROR: Decode Pvc body is failed, because " + err.Error())
+		return pvc, err
 	}
-	s := []string{}
-	if nodeLabel != "" {
-		s = append(s, nodeLabel)
+	return pvc, nil
+}
+
+func pvcIsLocal(pvc corev1.PersistentVolumeClaim) bool {
+	if pvc.Spec.StorageClassName == nil {
+		return false
 	}
-	if len(nodeSelectorMap) > 0 {
-		for key, value := range nodeSelectorMap {
-			s = append(s, key+"="+value)
-		}
+	isLocal, err := k8sclient.StorageClassIsNokiaLocal(*(pvc.Spec.StorageClassName))
+	if err != nil {
+		log.Println("ERROR: Cannot check storageclass " + pvc.ObjectMeta.Name + " pvc, ID: " + string(pvc.ObjectMeta.UID) + ", because " + err.Error())
+	}
+	return isLocal
+}
+
+func (mutator *Mutator) setNodeSelector(pvc corev1.PersistentVolumeClaim, patchList []patch) ([]patch, string, error) {
+	selector, err := mutator.buildNodeSelector(pvc)
+	if err != nil {
+		return patchList, "", err
+	}
+	storageClass, err := k8sclient.GetStorageClass(*pvc.Spec.StorageClassName)
+	if err != nil {
+		return patchList, "", errors.New("Cannot get storageclass " + *pvc.Spec.StorageClassName + ", because: " + err.Error())
+	}
+	method, strategy, err := nodeselector.StrategyOf(storageClass, mutator.nodeSelectMethod)
+	if err != nil {
+		return patchList, "", err
+	}
+	nodes, err := mutator.nodes.List(selector)
+	if err != nil {
+		return patchList, "", errors.New("ERROR: Cannot query node by label, because: " + err.Error())
+	}
+	request, failedNodes, err := mutator.placementRequest(pvc, selector)
+	if err != nil {
+		return patchList, "", err
+	}
+	request.Group, err = nodeselector.GroupOf(pvc)
+	if err != nil {
+		return patchList, "", err
+	}
+	if request.Group != nil {
+		mutator.claims.GroupNodes(request.Group, pvc)
+		mutator.reservations.GroupNodes(request.Group, pvc)
+	}
+	if err = mutator.colocate(request); err != nil {
+		return patchList, "", err
+	}
+	if err = mutator.spreadTopology(request, storageClass); err != nil {
+		return patchList, "", err
+	}
+	mutator.reservations.Subtract(nodes)
+	result, err := nodeselector.Select(strategy, request, nodes)
+	if err != nil {
+		return patchList, "", err
+	}
+	node := result.Node
+	mutator.reservations.Reserve(&pvc, node.ObjectMeta.Name)
+	if mutator.dryRun {
+		metrics.DryRunPlacements.WithLabelValues(node.ObjectMeta.Name, method).Inc()
 	} else {
-		if scDefaultSelector, ok := parsedDefaultSelector[*pvc.Spec.StorageClassName]; ok {
-			for _, selector := range strings.Split(scDefaultSelector.DefaultNodeSelector, ",") {
-				key := strings.Trim(strings.Split(selector, ":")[0], "\"{}")
-				value := strings.Trim(strings.Split(selector, ":")[1], "\"{}")
-				s = append(s, key+"="+value)
-			}
+		metrics.PlacementDecisions.WithLabelValues(node.ObjectMeta.Name, method).Inc()
+	}
+	explanation, err := json.Marshal(nodeselector.Explain(method, request, nodes, result))
+	if err != nil {
+		return patchList, "", errors.New("Cannot marshal placement explanation, because: " + err.Error())
+	}
+	annotations := map[string]string{
+		nodeNameAnnotation:                 node.ObjectMeta.Name,
+		nodeselector.ExplanationAnnotation: string(explanation),
+	}
+	// The claim carries the failed nodes of its previous incarnations on, a claim created from a template has none
+	if len(failedNodes) > 0 {
+		annotations[k8sclient.FailedNodes] = strings.Join(failedNodes, ",")
+	}
+	patchList = addAnnotations(pvc, patchList, annotations)
+	return patchList, node.ObjectMeta.Name, nil
+}
+
+// placementRequest asks for the claim with the node checks of the provisioner, avoiding the nodes which failed it
+// before, on the nodes its pods can run on. It returns the failed nodes too, the claim carries them on.
+func (mutator *Mutator) placementRequest(pvc corev1.PersistentVolumeClaim, selector string) (*nodeselector.Request, []string, error) {
+	request := nodeselector.NewRequest(pvc, selector)
+	failedNodes := mutator.failedNodes(pvc)
+	request.NodeChecks = append(append([]nodeselector.NodeCheck{}, mutator.nodeChecks...), avoidFailedNodes(failedNodes))
+	if err := mutator.setSchedulability(request); err != nil {
+		return nil, nil, err
+	}
+	return request, failedNodes, nil
+}
+
+// colocate finds the node of the claims the request has to share its node with, the informer may lag behind
+// the placements of this replica
+func (mutator *Mutator) colocate(request *nodeselector.Request) error {
+	var err error
+	request.Colocation, err = nodeselector.ColocationOf(request.Pvc)
+	if err != nil || request.Colocation == nil {
+		return err
+	}
+	mutator.reservations.Locate(request.Colocation, request.Pvc)
+	if request.Colocation.Node != "" {
+		return nil
+	}
+	return mutator.claims.Locate(request.Colocation, request.Pvc)
+}
+
+// avoidFailedNodes rejects the nodes which failed the earlier incarnations of a rescheduled claim
+// failedNodes lists the nodes which failed the claim before, from its annotation and the rescheduling history
+func (mutator *Mutator) failedNodes(pvc corev1.PersistentVolumeClaim) []string {
+	failedNodes := []string{}
+	if nodes, ok := pvc.ObjectMeta.Annotations[k8sclient.FailedNodes]; ok && nodes != "" {
+		failedNodes = strings.Split(nodes, ",")
+	}
+	if mutator.history == nil || pvc.ObjectMeta.Name == "" {
+		return failedNodes
+	}
+	for _, node := range mutator.history.FailedNodes(pvc.ObjectMeta.Namespace, pvc.ObjectMeta.Name) {
+		if !containsString(failedNodes, node) {
+			failedNodes = append(failedNodes, node)
 		}
 	}
-	selector := strings.Join(s, ",")
-	node, err := k8sclient.GetNodeByLabel(selector, nodeSelectMethod, rr)
+	return failedNodes
+}
+
+func avoidFailedNodes(failedNodes []string) nodeselector.NodeCheck {
+	return func(node *corev1.Node) error {
+		if containsString(failedNodes, node.ObjectMeta.Name) {
+			return errors.New("Node failed to provision the claim before")
+		}
+		return nil
+	}
+}
+
+func containsString(list []string, item string) bool {
+	for _, element := range list {
+		if element == item {
+			return true
+		}
+	}
+	return false
+}
+
+// setSchedulability collects the taints the volumes of the StorageClass tolerate, and the restrictions of the namespace
+func (mutator *Mutator) setSchedulability(request *nodeselector.Request) error {
+	if scConfig, ok := mutator.config.Get()[*request.Pvc.Spec.StorageClassName]; ok {
+		request.Tolerations = scConfig.Tolerations()
+	}
+	namespace, err := k8sclient.GetNamespace(request.Pvc.ObjectMeta.Namespace)
 	if err != nil {
-		return patchList, "", errors.New("ERROR: Cannot query node by label, because: " + err.Error())
+		return errors.New("Cannot get namespace " + request.Pvc.ObjectMeta.Namespace + ", because: " + err.Error())
 	}
-	patchItem.Op = "add"
-	patchItem.Path = "/metadata/annotations"
-	patchItem.Value = json.RawMessage(`{"` + nodeNameAnnotation + `":"` + node.ObjectMeta.Name + `"}`)
+	request.Namespace, err = nodeselector.NamespaceOf(namespace)
+	return err
+}
 
-	patchList = append(patchList, patchItem)
-	return patchList, node.ObjectMeta.Name, nil
+// spreadTopology counts the volumes and reserved claims per domain of the topology key of the StorageClass
+func (mutator *Mutator) spreadTopology(request *nodeselector.Request, storageClass *storagev1.StorageClass) error {
+	key := mutator.topologyKey
+	if scKey, ok := storageClass.Parameters[nodeselector.TopologyParameter]; ok {
+		key = scKey
+	}
+	if key == "" {
+		return nil
+	}
+	allNodes, err := mutator.nodes.List("")
+	if err != nil {
+		return err
+	}
+	request.Topology = nodeselector.NewTopology(key, allNodes)
+	request.Topology.CountVolumes(mutator.volumes, mutator.claims, storageClass.ObjectMeta.Name, request.Group)
+	mutator.reservations.CountTopology(request.Topology, storageClass.ObjectMeta.Name, request.Group, request.Pvc)
+	return nil
+}
+
+func (mutator *Mutator) buildNodeSelector(pvc corev1.PersistentVolumeClaim) (string, error) {
+	pvcSelector := labels.Everything()
+	if nodeSel, ok := pvc.ObjectMeta.Annotations[nodeSelector]; ok {
+		var err error
+		pvcSelector, err = config.ParseSelector(nodeSel)
+		if err != nil {
+			return "", errors.New("ERROR: Cannot parse nodeselector " + nodeSel + " because: " + err.Error())
+		}
+	}
+	if pvcSelector.Empty() {
+		if scConfig, ok := mutator.config.Get()[*pvc.Spec.StorageClassName]; ok {
+			// The active config is validated before being swapped in
+			pvcSelector, _ = config.ParseSelector(scConfig.DefaultNodeSelector)
+		}
+	}
+	return config.CombineSelectors(mutator.nodeLabel, pvcSelector).String(), nil
 }
 
 func patchVolumeNameAndPvDir(pvc corev1.PersistentVolumeClaim, nodeName string, patchList []patch) []patch {
@@ -0,0 +1,162 @@
+package mutator
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/nokia/dynamic-local-pv-provisioner/pkg/k8sclient"
+	"github.com/nokia/dynamic-local-pv-provisioner/pkg/metrics"
+	"github.com/nokia/dynamic-local-pv-provisioner/pkg/nodeselector"
+	admissionv1 "k8s.io/api/admission/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func (mutator *Mutator) ServeValidatePvc(w http.ResponseWriter, r *http.Request) {
+	serve(w, r, validatingWebhook, func(ar admissionv1.AdmissionReview) *admissionv1.AdmissionResponse {
+		if mutator.dryRun {
+			return shadow(validatingWebhook, ar, mutator.validatePvcs(ar))
+		}
+		return mutator.validatePvcs(ar)
+	})
+}
+
+func (mutator *Mutator) validatePvcs(ar admissionv1.AdmissionReview) *admissionv1.AdmissionResponse {
+	pvc, err := decodePvc(ar.Request.Object.Raw)
+	if err != nil {
+		return admissionError(validatingWebhook, "decode", err)
+	}
+	reviewResponse := admissionv1.AdmissionResponse{}
+	reviewResponse.Allowed = true
+
+	if ar.Request.Operation == admissionv1.Update {
+		return mutator.validatePvcUpdate(ar, pvc)
+	}
+	if !pvcIsLocal(pvc) {
+		return &reviewResponse
+	}
+	violations := validateAccessModes(pvc)
+	if pvDirName, ok := pvc.ObjectMeta.Annotations[k8sclient.PvDirName]; ok {
+		if err = validatePvDirName(pvDirName); err != nil {
+			violations = append(violations, err.Error())
+		}
+	}
+	if _, err = nodeselector.GroupOf(pvc); err != nil {
+		violations = append(violations, err.Error())
+	}
+	if _, err = nodeselector.ColocationOf(pvc); err != nil {
+		violations = append(violations, err.Error())
+	}
+	selector, err := mutator.buildNodeSelector(pvc)
+	if err != nil {
+		violations = append(violations, err.Error())
+		return toValidationResponse("invalid_selector", violations)
+	}
+	placementViolations, err := mutator.validatePlacement(pvc, selector)
+	if err != nil {
+		return admissionError(validatingWebhook, "placement", err)
+	}
+	violations = append(violations, placementViolations...)
+	if len(violations) > 0 {
+		return toValidationResponse("invalid", violations)
+	}
+	return &reviewResponse
+}
+
+// Only the internal annotations can be tampered with after creation, the spec of the claim is immutable.
+// Every update of every claim passes here, so the ones which leave the internal annotations alone are
+// admitted before any call to the API server
+func (mutator *Mutator) validatePvcUpdate(ar admissionv1.AdmissionReview, pvc corev1.PersistentVolumeClaim) *admissionv1.AdmissionResponse {
+	oldPvc, err := decodePvc(ar.Request.OldObject.Raw)
+	if err != nil {
+		return admissionError(validatingWebhook, "decode", err)
+	}
+	if !changedInternalAnnotations(oldPvc, pvc) || !pvcIsLocal(pvc) {
+		return &admissionv1.AdmissionResponse{Allowed: true}
+	}
+	if err = mutator.authorizeInternalAnnotations(ar.Request, pvc.ObjectMeta.Namespace); err != nil {
+		return toValidationResponse("unauthorized", []string{err.Error()})
+	}
+	if pvDirName, ok := pvc.ObjectMeta.Annotations[k8sclient.PvDirName]; ok {
+		if err = validatePvDirName(pvDirName); err != nil {
+			return toValidationResponse("invalid", []string{err.Error()})
+		}
+	}
+	return &admissionv1.AdmissionResponse{Allowed: true}
+}
+
+func validateAccessModes(pvc corev1.PersistentVolumeClaim) []string {
+	violations := []string{}
+	for _, accessMode := range pvc.Spec.AccessModes {
+		if accessMode != corev1.ReadWriteOnce {
+			violations = append(violations, "access mode "+string(accessMode)+" is not supported by local volumes, only "+string(corev1.ReadWriteOnce)+" is")
+		}
+	}
+	return violations
+}
+
+// validatePlacement checks the nodes with the same filters the placement uses, so a claim is rejected up front
+// when no node can host it, or when the node it is pinned to cannot
+func (mutator *Mutator) validatePlacement(pvc corev1.PersistentVolumeClaim, selector string) ([]string, error) {
+	storageClass, err := k8sclient.GetStorageClass(*pvc.Spec.StorageClassName)
+	if err != nil {
+		return nil, errors.New("Cannot get storageclass " + *pvc.Spec.StorageClassName + ", because: " + err.Error())
+	}
+	_, strategy, err := nodeselector.StrategyOf(storageClass, mutator.nodeSelectMethod)
+	if err != nil {
+		return nil, err
+	}
+	eligibleNodes, err := mutator.nodes.List(selector)
+	if err != nil {
+		return nil, errors.New("Cannot query node by label, because: " + err.Error())
+	}
+	request, _, err := mutator.placementRequest(pvc, selector)
+	if err != nil {
+		return nil, err
+	}
+	if nodeName, ok := pvc.ObjectMeta.Annotations[k8sclient.NodeName]; ok {
+		return mutator.validateNodeName(request, nodeName, eligibleNodes)
+	}
+	if len(eligibleNodes) == 0 {
+		return []string{"no nodes found for label: " + selector}, nil
+	}
+	if feasible, rejected := nodeselector.Filter(strategy, request, eligibleNodes); len(feasible) == 0 {
+		return []string{"no node found for label: " + selector + " which can host the requested " + request.Size.String() + " of local storage: " + nodeselector.DescribeRejections(rejected)}, nil
+	}
+	return nil, nil
+}
+
+// validateNodeName rejects the claim pinned to a node which does not exist, is not selected or cannot host it
+func (mutator *Mutator) validateNodeName(request *nodeselector.Request, nodeName string, eligibleNodes []corev1.Node) ([]string, error) {
+	for i := range eligibleNodes {
+		if eligibleNodes[i].ObjectMeta.Name != nodeName {
+			continue
+		}
+		if err := nodeselector.CanHost(request, &eligibleNodes[i]); err != nil {
+			return []string{k8sclient.NodeName + " names node " + nodeName + " which cannot host the claim: " + err.Error()}, nil
+		}
+		return nil, nil
+	}
+	allNodes, err := mutator.nodes.List("")
+	if err != nil {
+		return nil, errors.New("Cannot query nodes, because: " + err.Error())
+	}
+	for _, node := range allNodes {
+		if node.ObjectMeta.Name == nodeName {
+			return []string{k8sclient.NodeName + " names node " + nodeName + " which is not selected by label: " + request.Selector}, nil
+		}
+	}
+	return []string{k8sclient.NodeName + " names node " + nodeName + " which does not exist"}, nil
+}
+
+func toValidationResponse(reason string, violations []string) *admissionv1.AdmissionResponse {
+	metrics.AdmissionErrors.WithLabelValues(validatingWebhook, reason).Inc()
+	return &admissionv1.AdmissionResponse{
+		Result: &metav1.Status{
+			Message: "Local PVC is rejected: " + strings.Join(violations, "; "),
+			Reason:  metav1.StatusReasonInvalid,
+		},
+		Allowed: false,
+	}
+}
@@ -0,0 +1,79 @@
+package nodelabels
+
+import (
+	"log"
+	"strconv"
+	"sync"
+
+	"github.com/nokia/dynamic-local-pv-provisioner/pkg/k8sclient"
+	"github.com/nokia/dynamic-local-pv-provisioner/pkg/lease"
+)
+
+const (
+	// ReadyLabel is set to "true" while the executor of the node is up and its local storage passes the preflight checks
+	ReadyLabel   = "nokia.k8s.io/local-storage"
+	BackendLabel = "nokia.k8s.io/local-storage-backend"
+	TierLabel    = "nokia.k8s.io/local-storage-tier"
+	ReflinkLabel = "nokia.k8s.io/local-storage-reflink"
+)
+
+// Labeller publishes the local storage capabilities of the node as labels, so node selectors can target them
+type Labeller struct {
+	lock         sync.Mutex
+	nodeName     string
+	capabilities map[string]string
+	ready        *bool
+}
+
+// NewLabeller describes the storage of the node, the tier label is left out when tier is empty
+func NewLabeller(nodeName string, tier string, reflink bool) *Labeller {
+	capabilities := map[string]string{
+		BackendLabel: lease.Backend,
+		ReflinkLabel: strconv.FormatBool(reflink),
+	}
+	if tier != "" {
+		capabilities[TierLabel] = tier
+	}
+	return &Labeller{nodeName: nodeName, capabilities: capabilities}
+}
+
+// SetReady labels the node with its capabilities when ready, or removes the ready label when not
+func (labeller *Labeller) SetReady(ready bool) {
+	labeller.lock.Lock()
+	defer labeller.lock.Unlock()
+	if labeller.ready != nil && *labeller.ready == ready {
+		return
+	}
+	labels := make(map[string]*string)
+	if ready {
+		for key := range labeller.capabilities {
+			value := labeller.capabilities[key]
+			labels[key] = &value
+		}
+		readyValue := "true"
+		labels[ReadyLabel] = &readyValue
+	} else {
+		labels[ReadyLabel] = nil
+	}
+	if err := k8sclient.PatchNodeLabels(labeller.nodeName, labels); err != nil {
+		log.Println("ERROR: Cannot label node " + labeller.nodeName + ", because: " + err.Error())
+		return
+	}
+	labeller.ready = &ready
+}
+
+// Remove deletes every label of the labeller from the node, when the executor stops
+func (labeller *Labeller) Remove() {
+	labeller.lock.Lock()
+	defer labeller.lock.Unlock()
+	labels := map[string]*string{ReadyLabel: nil}
+	for key := range labeller.capabilities {
+		labels[key] = nil
+	}
+	if err := k8sclient.PatchNodeLabels(labeller.nodeName, labels); err != nil {
+		log.Println("ERROR: Cannot remove labels of node " + labeller.nodeName + ", because: " + err.Error())
+		return
+	}
+	notReady := false
+	labeller.ready = &notReady
+}
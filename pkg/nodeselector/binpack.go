@@ -0,0 +1,33 @@
+package nodeselector
+
+import (
+	"github.com/nokia/dynamic-local-pv-provisioner/pkg/k8sclient"
+	v1 "k8s.io/api/core/v1"
+)
+
+// binPack selects the fullest node which still fits the claim, keeping whole disks free for large claims
+type binPack struct{}
+
+func init() {
+	Register(k8sclient.BinPack, func() (NodeSelector, error) { return &binPack{}, nil })
+}
+
+func (strategy *binPack) Filter(request *Request, node *v1.Node) error {
+	return nil
+}
+
+func (strategy *binPack) Score(request *Request, nodes []v1.Node) map[string]int64 {
+	var maxRemaining int64
+	remaining := make(map[string]int64, len(nodes))
+	for _, node := range nodes {
+		remaining[node.ObjectMeta.Name] = remainingCapacity(request, &node)
+		if remaining[node.ObjectMeta.Name] > maxRemaining {
+			maxRemaining = remaining[node.ObjectMeta.Name]
+		}
+	}
+	scores := make(map[string]int64, len(nodes))
+	for name, nodeRemaining := range remaining {
+		scores[name] = maxRemaining - nodeRemaining
+	}
+	return scores
+}
@@ -0,0 +1,46 @@
+package nodeselector
+
+import (
+	"errors"
+
+	"github.com/nokia/dynamic-local-pv-provisioner/pkg/k8sclient"
+	v1 "k8s.io/api/core/v1"
+)
+
+// maxCapacity selects the node with the most free local storage
+type maxCapacity struct{}
+
+func init() {
+	Register(k8sclient.Cap, func() (NodeSelector, error) { return &maxCapacity{}, nil })
+}
+
+func (strategy *maxCapacity) Filter(request *Request, node *v1.Node) error {
+	return nil
+}
+
+func (strategy *maxCapacity) Score(request *Request, nodes []v1.Node) map[string]int64 {
+	scores := make(map[string]int64, len(nodes))
+	for _, node := range nodes {
+		nodeCapacity := node.Status.Capacity[k8sclient.LvCapacity]
+		scores[node.ObjectMeta.Name] = (&nodeCapacity).Value()
+	}
+	return scores
+}
+
+// fitsRequest tells whether the free local storage of the node is enough for the requested size, every strategy filters with it
+func fitsRequest(request *Request, node *v1.Node) error {
+	nodeCapacity, ok := node.Status.Capacity[k8sclient.LvCapacity]
+	if !ok {
+		return errors.New("No lv-capacity set, yet!")
+	}
+	if (&nodeCapacity).Cmp(request.Size) < 0 {
+		return errors.New("Not enough " + k8sclient.LvCapacity + ", requested: " + request.Size.String() + ", available: " + nodeCapacity.String())
+	}
+	return nil
+}
+
+// remainingCapacity is the free local storage of the node after placing the claim
+func remainingCapacity(request *Request, node *v1.Node) int64 {
+	nodeCapacity := node.Status.Capacity[k8sclient.LvCapacity]
+	return (&nodeCapacity).Value() - (&request.Size).Value()
+}
@@ -0,0 +1,68 @@
+package nodeselector
+
+import (
+	"github.com/nokia/dynamic-local-pv-provisioner/pkg/k8sclient"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/client-go/tools/cache"
+)
+
+// Claims keeps the claims of the cluster up to date from an informer, the placement of the earlier claims is read from it
+type Claims struct {
+	informer cache.SharedIndexInformer
+}
+
+func NewClaims() (*Claims, error) {
+	informer, err := k8sclient.NewPvcInformer()
+	if err != nil {
+		return nil, err
+	}
+	return &Claims{informer: informer}, nil
+}
+
+func (claims *Claims) Run(stopCh <-chan struct{}) {
+	claims.informer.Run(stopCh)
+}
+
+func (claims *Claims) HasSynced() bool {
+	return claims.informer.HasSynced()
+}
+
+// List returns every claim of the cluster
+func (claims *Claims) List() []*v1.PersistentVolumeClaim {
+	list := []*v1.PersistentVolumeClaim{}
+	for _, obj := range claims.informer.GetStore().List() {
+		if pvc, ok := obj.(*v1.PersistentVolumeClaim); ok {
+			list = append(list, pvc)
+		}
+	}
+	return list
+}
+
+// Get returns the claim, or nil when it does not exist
+func (claims *Claims) Get(namespace string, name string) *v1.PersistentVolumeClaim {
+	obj, exists, err := claims.informer.GetStore().GetByKey(namespace + "/" + name)
+	if err != nil || !exists {
+		return nil
+	}
+	pvc, _ := obj.(*v1.PersistentVolumeClaim)
+	return pvc
+}
+
+// Placed returns the claims of the namespace which are already placed on a node, keyed by name
+func (claims *Claims) Placed(namespace string) map[string]*v1.PersistentVolumeClaim {
+	placed := make(map[string]*v1.PersistentVolumeClaim)
+	objs, err := claims.informer.GetIndexer().ByIndex(cache.NamespaceIndex, namespace)
+	if err != nil {
+		return placed
+	}
+	for _, obj := range objs {
+		pvc, ok := obj.(*v1.PersistentVolumeClaim)
+		if !ok {
+			continue
+		}
+		if _, ok = pvc.ObjectMeta.Annotations[k8sclient.NodeName]; ok {
+			placed[pvc.ObjectMeta.Name] = pvc
+		}
+	}
+	return placed
+}
@@ -0,0 +1,87 @@
+package nodeselector
+
+import (
+	"errors"
+
+	"github.com/nokia/dynamic-local-pv-provisioner/pkg/k8sclient"
+	v1 "k8s.io/api/core/v1"
+)
+
+const (
+	// ColocateWithAnnotation names another claim of the namespace, the claim is placed on the same node
+	ColocateWithAnnotation = "nokia.k8s.io/colocateWith"
+	// ColocationGroupAnnotation places every claim of the namespace with the same value on the same node
+	ColocationGroupAnnotation = "nokia.k8s.io/colocationGroup"
+)
+
+// Colocation describes the claims a claim must share its node with
+type Colocation struct {
+	Claim string
+	Group string
+	// Node is empty until one of the claims is placed
+	Node string
+	// PlacedBy names the claim the node is taken from
+	PlacedBy string
+}
+
+// ColocationOf returns the colocation of the claim, or nil when it is not colocated
+func ColocationOf(pvc v1.PersistentVolumeClaim) (*Colocation, error) {
+	claim, hasClaim := pvc.ObjectMeta.Annotations[ColocateWithAnnotation]
+	group, hasGroup := pvc.ObjectMeta.Annotations[ColocationGroupAnnotation]
+	if !hasClaim && !hasGroup {
+		return nil, nil
+	}
+	if hasClaim && hasGroup {
+		return nil, errors.New("Only one of " + ColocateWithAnnotation + " and " + ColocationGroupAnnotation + " can be set")
+	}
+	if hasClaim && (claim == "" || claim == pvc.ObjectMeta.Name) {
+		return nil, errors.New(ColocateWithAnnotation + " must name another claim of the namespace")
+	}
+	if hasGroup && group == "" {
+		return nil, errors.New(ColocationGroupAnnotation + " cannot be empty")
+	}
+	return &Colocation{Claim: claim, Group: group}, nil
+}
+
+// Locate finds the node of the referenced claim, or of a claim in the colocation group. A referenced claim
+// which is not placed yet rejects the claim, as the two of them could end up on different nodes.
+func (claims *Claims) Locate(colocation *Colocation, pvc v1.PersistentVolumeClaim) error {
+	placed := claims.Placed(pvc.ObjectMeta.Namespace)
+	if colocation.Claim != "" {
+		other, ok := placed[colocation.Claim]
+		if !ok {
+			return errors.New("Claim " + colocation.Claim + " referred by " + ColocateWithAnnotation + " is not placed on any node yet")
+		}
+		colocation.Node, colocation.PlacedBy = other.ObjectMeta.Annotations[k8sclient.NodeName], other.ObjectMeta.Name
+		return nil
+	}
+	for name, other := range placed {
+		if name != pvc.ObjectMeta.Name && other.ObjectMeta.Annotations[ColocationGroupAnnotation] == colocation.Group {
+			colocation.Node, colocation.PlacedBy = other.ObjectMeta.Annotations[k8sclient.NodeName], name
+			return nil
+		}
+	}
+	return nil
+}
+
+// colocate places the claim onto the node of its colocated claims, when the node is selected and fits it
+func colocate(request *Request, nodes []v1.Node) (Result, error) {
+	colocation := request.Colocation
+	result := Result{Rejected: make(map[string]string)}
+	for i := range nodes {
+		if nodes[i].ObjectMeta.Name != colocation.Node {
+			result.Rejected[nodes[i].ObjectMeta.Name] = "Claim " + colocation.PlacedBy + " to colocate with is on node " + colocation.Node
+			continue
+		}
+		if err := CanHost(request, &nodes[i]); err != nil {
+			result.Rejected[nodes[i].ObjectMeta.Name] = err.Error()
+			return result, errors.New("Cannot colocate the claim with claim " + colocation.PlacedBy + " on node " + colocation.Node + ", because: " + err.Error())
+		}
+		result.Node = nodes[i]
+		result.Scores = map[string]int64{colocation.Node: 1}
+	}
+	if result.Node.ObjectMeta.Name == "" {
+		return result, errors.New("Cannot colocate the claim with claim " + colocation.PlacedBy + ", because its node " + colocation.Node + " is not found for label:" + request.Selector)
+	}
+	return result, nil
+}
@@ -0,0 +1,155 @@
+package nodeselector
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/nokia/dynamic-local-pv-provisioner/pkg/k8sclient"
+	v1 "k8s.io/api/core/v1"
+)
+
+// ExplanationAnnotation records on the claim why it is placed on its node
+const ExplanationAnnotation = "nokia.k8s.io/placement"
+
+// The annotation has to fit next to the others in the 256KiB limit of the API server even in clusters of
+// thousands of nodes, so only the best candidates and the most common rejection reasons are recorded
+const (
+	maxCandidates      = 10
+	maxRejections      = 10
+	maxRejectedNodes   = 5
+	maxRejectionLength = 256
+	// Error messages end up in admission responses and events, so they name fewer reasons
+	maxDescribedRejections = 3
+)
+
+// Explanation tells which strategy and selector placed the claim, what the best candidate nodes offered and
+// why the other nodes were rejected
+type Explanation struct {
+	Strategy       string      `json:"strategy"`
+	Selector       string      `json:"selector"`
+	Requested      string      `json:"requested"`
+	Node           string      `json:"node"`
+	CandidateCount int         `json:"candidateCount"`
+	Candidates     []Candidate `json:"candidates"`
+	RejectedCount  int         `json:"rejectedCount,omitempty"`
+	Rejected       []Rejection `json:"rejected,omitempty"`
+}
+
+// Candidate is a node which passed the filters, its capacity is the free lv-capacity less the reservations
+type Candidate struct {
+	Node     string `json:"node"`
+	Capacity string `json:"capacity"`
+	Score    int64  `json:"score"`
+}
+
+// Rejection counts the nodes rejected for the same reason and names some of them
+type Rejection struct {
+	Reason string   `json:"reason"`
+	Count  int      `json:"count"`
+	Nodes  []string `json:"nodes"`
+}
+
+func Explain(strategy string, request *Request, nodes []v1.Node, result Result) Explanation {
+	explanation := Explanation{
+		Strategy:      strategy,
+		Selector:      request.Selector,
+		Requested:     request.Size.String(),
+		Node:          result.Node.ObjectMeta.Name,
+		Candidates:    []Candidate{},
+		RejectedCount: len(result.Rejected),
+		Rejected:      summarizeRejections(result.Rejected),
+	}
+	for _, node := range nodes {
+		score, ok := result.Scores[node.ObjectMeta.Name]
+		if !ok {
+			continue
+		}
+		nodeCapacity := node.Status.Capacity[k8sclient.LvCapacity]
+		explanation.Candidates = append(explanation.Candidates, Candidate{Node: node.ObjectMeta.Name, Capacity: nodeCapacity.String(), Score: score})
+	}
+	// The selected node comes first, then the others by score
+	sort.SliceStable(explanation.Candidates, func(i, j int) bool {
+		if explanation.Candidates[i].Node == explanation.Node || explanation.Candidates[j].Node == explanation.Node {
+			return explanation.Candidates[i].Node == explanation.Node
+		}
+		return explanation.Candidates[i].Score > explanation.Candidates[j].Score
+	})
+	explanation.CandidateCount = len(explanation.Candidates)
+	if len(explanation.Candidates) > maxCandidates {
+		explanation.Candidates = explanation.Candidates[:maxCandidates]
+	}
+	return explanation
+}
+
+// DescribeRejections tells the most common rejection reasons with some of their nodes, and how many nodes
+// were rejected for other reasons
+func DescribeRejections(rejected map[string]string) string {
+	rejections := summarizeRejections(rejected)
+	if len(rejections) > maxDescribedRejections {
+		rejections = rejections[:maxDescribedRejections]
+	}
+	described := 0
+	reasons := make([]string, 0, len(rejections)+1)
+	for _, rejection := range rejections {
+		nodes := strings.Join(rejection.Nodes, ", ")
+		if rejection.Count > len(rejection.Nodes) {
+			nodes += ", ..."
+		}
+		reasons = append(reasons, rejection.Reason+" ("+strconv.Itoa(rejection.Count)+" nodes: "+nodes+")")
+		described += rejection.Count
+	}
+	if more := len(rejected) - described; more > 0 {
+		reasons = append(reasons, "and "+strconv.Itoa(more)+" more nodes rejected for other reasons")
+	}
+	return strings.Join(reasons, "; ")
+}
+
+func summarizeRejections(rejected map[string]string) []Rejection {
+	byReason := make(map[string]*Rejection)
+	for node, reason := range rejected {
+		reason = truncate(reason, maxRejectionLength)
+		rejection, ok := byReason[reason]
+		if !ok {
+			rejection = &Rejection{Reason: reason}
+			byReason[reason] = rejection
+		}
+		rejection.Count++
+		rejection.Nodes = append(rejection.Nodes, node)
+	}
+	rejections := make([]Rejection, 0, len(byReason))
+	for _, rejection := range byReason {
+		sort.Strings(rejection.Nodes)
+		if len(rejection.Nodes) > maxRejectedNodes {
+			rejection.Nodes = rejection.Nodes[:maxRejectedNodes]
+		}
+		rejections = append(rejections, *rejection)
+	}
+	sort.Slice(rejections, func(i, j int) bool {
+		if rejections[i].Count != rejections[j].Count {
+			return rejections[i].Count > rejections[j].Count
+		}
+		return rejections[i].Reason < rejections[j].Reason
+	})
+	if len(rejections) > maxRejections {
+		rejections = rejections[:maxRejections]
+	}
+	return rejections
+}
+
+// truncate cuts the text to at most maxLength bytes on a rune boundary, the API server refuses invalid UTF-8
+func truncate(text string, maxLength int) string {
+	if len(text) <= maxLength {
+		return text
+	}
+	end := 0
+	for end < len(text) {
+		_, size := utf8.DecodeRuneInString(text[end:])
+		if end+size > maxLength {
+			break
+		}
+		end += size
+	}
+	return text[:end] + "..."
+}
@@ -0,0 +1,92 @@
+package nodeselector
+
+import (
+	"encoding/json"
+	"strconv"
+	"strings"
+	"testing"
+	"unicode/utf8"
+
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestExplainIsBounded(t *testing.T) {
+	nodes := []v1.Node{}
+	result := Result{Scores: make(map[string]int64), Rejected: make(map[string]string)}
+	for i := 0; i < 5000; i++ {
+		name := "node-with-a-rather-long-name-of-the-kind-some-clouds-generate-" + strconv.Itoa(i)
+		nodes = append(nodes, v1.Node{ObjectMeta: metav1.ObjectMeta{Name: name}})
+		switch {
+		case i < 1000:
+			result.Scores[name] = int64(i)
+		case i < 3000:
+			result.Rejected[name] = "Node is cordoned"
+		default:
+			result.Rejected[name] = "Not enough lv-capacity, available: " + strconv.Itoa(i) + "Gi"
+		}
+	}
+	result.Node = nodes[10]
+	request := &Request{Selector: "disk=ssd", Size: resource.MustParse("10Gi")}
+	explanation := Explain("binpack", request, nodes, result)
+
+	if explanation.CandidateCount != 1000 || len(explanation.Candidates) != maxCandidates {
+		t.Errorf("got %d of %d candidates, want %d of 1000", len(explanation.Candidates), explanation.CandidateCount, maxCandidates)
+	}
+	if explanation.Candidates[0].Node != result.Node.ObjectMeta.Name {
+		t.Errorf("first candidate is %s, want the selected node %s", explanation.Candidates[0].Node, result.Node.ObjectMeta.Name)
+	}
+	if explanation.Candidates[1].Score != 999 {
+		t.Errorf("second candidate scores %d, want the best score 999", explanation.Candidates[1].Score)
+	}
+	if explanation.RejectedCount != 4000 || len(explanation.Rejected) != maxRejections {
+		t.Errorf("got %d reasons for %d rejected nodes, want %d reasons for 4000", len(explanation.Rejected), explanation.RejectedCount, maxRejections)
+	}
+	if explanation.Rejected[0].Reason != "Node is cordoned" || explanation.Rejected[0].Count != 2000 || len(explanation.Rejected[0].Nodes) != maxRejectedNodes {
+		t.Errorf("most common rejection is %+v, want 2000 cordoned nodes naming %d", explanation.Rejected[0], maxRejectedNodes)
+	}
+	annotation, err := json.Marshal(explanation)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(annotation) > 16*1024 {
+		t.Errorf("explanation of 5000 nodes takes %d bytes", len(annotation))
+	}
+}
+
+func TestSummarizeRejectionsKeepsUTF8(t *testing.T) {
+	// Every rune takes three bytes, so the limit falls inside a rune
+	reason := strings.Repeat("容量不足", maxRejectionLength)
+	rejections := summarizeRejections(map[string]string{"node-1": reason})
+	if len(rejections) != 1 {
+		t.Fatalf("got %d rejections, want 1", len(rejections))
+	}
+	summarized := rejections[0].Reason
+	if !utf8.ValidString(summarized) {
+		t.Errorf("summarized reason %q is not valid UTF-8", summarized)
+	}
+	if !strings.HasSuffix(summarized, "...") || len(summarized) > maxRejectionLength+len("...") {
+		t.Errorf("summarized reason takes %d bytes, want at most %d ending in ...", len(summarized), maxRejectionLength+len("..."))
+	}
+}
+
+func TestDescribeRejectionsIsBounded(t *testing.T) {
+	rejected := make(map[string]string)
+	for i := 0; i < 5000; i++ {
+		rejected["node-"+strconv.Itoa(i)] = "Not enough lv-capacity, available: " + strconv.Itoa(i) + "Gi"
+	}
+	for i := 5000; i < 7000; i++ {
+		rejected["node-"+strconv.Itoa(i)] = "Node is cordoned"
+	}
+	description := DescribeRejections(rejected)
+	if !strings.HasPrefix(description, "Node is cordoned (2000 nodes: ") {
+		t.Errorf("description %q does not start with the most common reason", description)
+	}
+	if !strings.HasSuffix(description, "and 4998 more nodes rejected for other reasons") {
+		t.Errorf("description %q does not count the nodes left out", description)
+	}
+	if len(description) > 2*1024 {
+		t.Errorf("description of 7000 rejected nodes takes %d bytes", len(description))
+	}
+}
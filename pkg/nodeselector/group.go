@@ -0,0 +1,78 @@
+package nodeselector
+
+import (
+	"errors"
+	"regexp"
+
+	"github.com/nokia/dynamic-local-pv-provisioner/pkg/k8sclient"
+	v1 "k8s.io/api/core/v1"
+)
+
+const (
+	// GroupAnnotation names the group of a claim, the claims of a StatefulSet form a group without it
+	GroupAnnotation = "nokia.k8s.io/group"
+	// GroupAntiAffinityAnnotation spreads the claims of the group over distinct nodes
+	GroupAntiAffinityAnnotation = "nokia.k8s.io/groupAntiAffinity"
+	// HardAntiAffinity rejects the claim when every node hosts a volume of its group already
+	HardAntiAffinity = "hard"
+	// SoftAntiAffinity only prefers the nodes without a volume of the group
+	SoftAntiAffinity = "soft"
+)
+
+// StatefulSets name their claims <volumeClaimTemplate>-<statefulSet>-<ordinal>
+var statefulSetClaimName = regexp.MustCompile(`^(.+)-[0-9]+$`)
+
+// Group describes the anti-affinity of a claim to the other claims of its group
+type Group struct {
+	Name string
+	Hard bool
+	// Nodes already hosting a volume of the group
+	Nodes map[string]bool
+}
+
+// GroupOf returns the group of the claim, or nil when it is not spread
+func GroupOf(pvc v1.PersistentVolumeClaim) (*Group, error) {
+	antiAffinity, hasAntiAffinity := pvc.ObjectMeta.Annotations[GroupAntiAffinityAnnotation]
+	name, hasName := pvc.ObjectMeta.Annotations[GroupAnnotation]
+	if !hasAntiAffinity && !hasName {
+		return nil, nil
+	}
+	if !hasAntiAffinity {
+		antiAffinity = SoftAntiAffinity
+	}
+	if antiAffinity != HardAntiAffinity && antiAffinity != SoftAntiAffinity {
+		return nil, errors.New(GroupAntiAffinityAnnotation + " must be \"" + HardAntiAffinity + "\" or \"" + SoftAntiAffinity + "\", not \"" + antiAffinity + "\"")
+	}
+	if !hasName {
+		name = groupFromClaimName(pvc.ObjectMeta.Name)
+	}
+	if name == "" {
+		return nil, errors.New("Cannot derive the group of claim " + pvc.ObjectMeta.Name + " from its name, set " + GroupAnnotation)
+	}
+	return &Group{Name: name, Hard: antiAffinity == HardAntiAffinity, Nodes: make(map[string]bool)}, nil
+}
+
+// groupKey returns the group a placed claim belongs to, regardless of its anti-affinity
+func groupKey(pvc *v1.PersistentVolumeClaim) string {
+	if name, ok := pvc.ObjectMeta.Annotations[GroupAnnotation]; ok {
+		return name
+	}
+	return groupFromClaimName(pvc.ObjectMeta.Name)
+}
+
+func groupFromClaimName(name string) string {
+	matches := statefulSetClaimName.FindStringSubmatch(name)
+	if matches == nil {
+		return ""
+	}
+	return matches[1]
+}
+
+// GroupNodes collects the nodes hosting the other claims of the group in the namespace
+func (claims *Claims) GroupNodes(group *Group, pvc v1.PersistentVolumeClaim) {
+	for name, placed := range claims.Placed(pvc.ObjectMeta.Namespace) {
+		if name != pvc.ObjectMeta.Name && groupKey(placed) == group.Name {
+			group.Nodes[placed.ObjectMeta.Annotations[k8sclient.NodeName]] = true
+		}
+	}
+}
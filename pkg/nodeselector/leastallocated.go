@@ -0,0 +1,35 @@
+package nodeselector
+
+import (
+	"errors"
+
+	"github.com/nokia/dynamic-local-pv-provisioner/pkg/k8sclient"
+	v1 "k8s.io/api/core/v1"
+)
+
+// ratioScale keeps the resolution of the free capacity ratios in integer scores
+const ratioScale = 1000000
+
+// leastAllocated selects the node with the largest fraction of its local storage left free after placing the claim
+type leastAllocated struct{}
+
+func init() {
+	Register(k8sclient.LeastAllocated, func() (NodeSelector, error) { return &leastAllocated{}, nil })
+}
+
+func (strategy *leastAllocated) Filter(request *Request, node *v1.Node) error {
+	totalCapacity, ok := node.Status.Capacity[k8sclient.LvTotalCapacity]
+	if !ok || (&totalCapacity).Value() <= 0 {
+		return errors.New("No " + k8sclient.LvTotalCapacity + " set, yet!")
+	}
+	return nil
+}
+
+func (strategy *leastAllocated) Score(request *Request, nodes []v1.Node) map[string]int64 {
+	scores := make(map[string]int64, len(nodes))
+	for _, node := range nodes {
+		totalCapacity := node.Status.Capacity[k8sclient.LvTotalCapacity]
+		scores[node.ObjectMeta.Name] = int64(float64(remainingCapacity(request, &node)) / float64((&totalCapacity).Value()) * ratioScale)
+	}
+	return scores
+}
@@ -0,0 +1,50 @@
+package nodeselector
+
+import (
+	"errors"
+	"sort"
+
+	"github.com/nokia/dynamic-local-pv-provisioner/pkg/k8sclient"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/tools/cache"
+)
+
+// Nodes keeps the nodes of the cluster up to date from an informer, so joining and leaving nodes are selectable at once
+type Nodes struct {
+	informer cache.SharedIndexInformer
+}
+
+func NewNodes() (*Nodes, error) {
+	informer, err := k8sclient.NewNodeInformer()
+	if err != nil {
+		return nil, err
+	}
+	return &Nodes{informer: informer}, nil
+}
+
+func (nodes *Nodes) Run(stopCh <-chan struct{}) {
+	nodes.informer.Run(stopCh)
+}
+
+func (nodes *Nodes) HasSynced() bool {
+	return nodes.informer.HasSynced()
+}
+
+// List returns the nodes matching the label selector ordered by name
+func (nodes *Nodes) List(selector string) ([]v1.Node, error) {
+	labelSelector, err := labels.Parse(selector)
+	if err != nil {
+		return nil, errors.New("Cannot parse node label " + selector + ", because: " + err.Error())
+	}
+	list := []v1.Node{}
+	for _, obj := range nodes.informer.GetStore().List() {
+		node, ok := obj.(*v1.Node)
+		if !ok || !labelSelector.Matches(labels.Set(node.ObjectMeta.Labels)) {
+			continue
+		}
+		list = append(list, *node.DeepCopy())
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].ObjectMeta.Name < list[j].ObjectMeta.Name })
+	return list, nil
+}
@@ -0,0 +1,239 @@
+package nodeselector
+
+import (
+	"errors"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/nokia/dynamic-local-pv-provisioner/pkg/k8sclient"
+	v1 "k8s.io/api/core/v1"
+	storagev1 "k8s.io/api/storage/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+)
+
+// StorageClassParameter selects the strategy of a StorageClass, overriding --node-selector-method
+const StorageClassParameter = "nodeSelectorMethod"
+
+// Request describes the claim a node is selected for
+type Request struct {
+	Pvc      v1.PersistentVolumeClaim
+	Size     resource.Quantity
+	Selector string
+	// Group is nil when the claim is not spread
+	Group *Group
+	// Colocation is nil when the claim is not colocated with other claims
+	Colocation *Colocation
+	// Topology is nil when the claims are not spread over topology domains
+	Topology *Topology
+	// Tolerations are the taints the volumes of the StorageClass tolerate
+	Tolerations []v1.Toleration
+	// Namespace is nil when the namespace of the claim does not restrict the nodes of its pods
+	Namespace *Namespace
+	// SchedulerFiltered is set when the scheduler has filtered the nodes for the pod already
+	SchedulerFiltered bool
+	// Peek scores the nodes without advancing the state of the strategy, as nothing is placed by the score
+	Peek bool
+	// NodeChecks reject the nodes the provisioner itself cannot serve
+	NodeChecks []NodeCheck
+}
+
+// NodeCheck returns why the node cannot host the local volumes, or nil when it can
+type NodeCheck func(node *v1.Node) error
+
+// NodeSelector is a node selection strategy. Filter drops the nodes that cannot host the claim,
+// Score ranks the remaining ones, the node with the highest score is selected.
+type NodeSelector interface {
+	Filter(request *Request, node *v1.Node) error
+	Score(request *Request, nodes []v1.Node) map[string]int64
+}
+
+type Factory func() (NodeSelector, error)
+
+// Result tells which node was selected, and why the others were not
+type Result struct {
+	Node     v1.Node
+	Scores   map[string]int64
+	Rejected map[string]string
+}
+
+var (
+	lock       sync.Mutex
+	factories  = make(map[string]Factory)
+	strategies = make(map[string]NodeSelector)
+)
+
+func NewRequest(pvc v1.PersistentVolumeClaim, selector string) *Request {
+	return &Request{Pvc: pvc, Size: pvc.Spec.Resources.Requests[v1.ResourceStorage], Selector: selector}
+}
+
+// Register makes a strategy selectable by name, strategies register themselves in init
+func Register(name string, factory Factory) {
+	lock.Lock()
+	defer lock.Unlock()
+	factories[name] = factory
+}
+
+// Get returns the shared instance of the named strategy, so stateful strategies keep their state across requests
+func Get(name string) (NodeSelector, error) {
+	lock.Lock()
+	defer lock.Unlock()
+	if strategy, ok := strategies[name]; ok {
+		return strategy, nil
+	}
+	factory, ok := factories[name]
+	if !ok {
+		return nil, errors.New("Unacceptable node selector method \"" + name + "\"! Acceptable values: " + acceptableNames())
+	}
+	strategy, err := factory()
+	if err != nil {
+		return nil, errors.New("Cannot initialize node selector method \"" + name + "\", because: " + err.Error())
+	}
+	strategies[name] = strategy
+	return strategy, nil
+}
+
+func Names() []string {
+	lock.Lock()
+	defer lock.Unlock()
+	names := make([]string, 0, len(factories))
+	for name := range factories {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func acceptableNames() string {
+	names := make([]string, 0, len(factories))
+	for name := range factories {
+		names = append(names, "\""+name+"\"")
+	}
+	sort.Strings(names)
+	return strings.Join(names, ", ")
+}
+
+// ForStorageClass returns the strategy named by the parameter of the StorageClass, or the default method when it has none
+func ForStorageClass(storageClassName string, defaultMethod string) (string, NodeSelector, error) {
+	storageClass, err := k8sclient.GetStorageClass(storageClassName)
+	if err != nil {
+		return "", nil, errors.New("Cannot get storageclass " + storageClassName + ", because: " + err.Error())
+	}
+	return StrategyOf(storageClass, defaultMethod)
+}
+
+// StrategyOf returns the strategy named by the parameter of the StorageClass, or the default method when it has none
+func StrategyOf(storageClass *storagev1.StorageClass, defaultMethod string) (string, NodeSelector, error) {
+	method := defaultMethod
+	if scMethod, ok := storageClass.Parameters[StorageClassParameter]; ok && scMethod != "" {
+		method = scMethod
+	}
+	strategy, err := Get(method)
+	if err != nil {
+		return "", nil, err
+	}
+	return method, strategy, nil
+}
+
+// Filter drops the nodes which are not schedulable or cannot fit the requested size, then runs the filter phase of the strategy.
+// It returns the feasible nodes with the reasons of the rejected ones.
+func Filter(strategy NodeSelector, request *Request, nodes []v1.Node) ([]v1.Node, map[string]string) {
+	feasible := []v1.Node{}
+	rejected := make(map[string]string)
+	for i := range nodes {
+		err := nodeIsSchedulable(request, &nodes[i])
+		if err == nil {
+			err = fitsRequest(request, &nodes[i])
+		}
+		if err == nil {
+			err = strategy.Filter(request, &nodes[i])
+		}
+		if err != nil {
+			rejected[nodes[i].ObjectMeta.Name] = err.Error()
+			continue
+		}
+		feasible = append(feasible, nodes[i])
+	}
+	return feasible, rejected
+}
+
+// CanHost tells why the node cannot host the claim placed on it already, the strategy has no say in such a placement
+func CanHost(request *Request, node *v1.Node) error {
+	if err := nodeIsSchedulable(request, node); err != nil {
+		return err
+	}
+	return fitsRequest(request, node)
+}
+
+// Select filters and scores the nodes, then returns the one with the highest score
+func Select(strategy NodeSelector, request *Request, nodes []v1.Node) (Result, error) {
+	if request.Colocation != nil && request.Colocation.Node != "" {
+		return colocate(request, nodes)
+	}
+	feasible, rejected := Filter(strategy, request, nodes)
+	result := Result{Rejected: rejected}
+	if len(nodes) == 0 {
+		return result, errors.New("No nodes found for label:" + request.Selector + "!")
+	}
+	if len(feasible) == 0 {
+		return result, errors.New("No node found for label:" + request.Selector + " which can fit the requested " + request.Size.String() + " of local storage! " + DescribeRejections(rejected))
+	}
+	feasible, err := spreadGroup(request, feasible, rejected)
+	if err != nil {
+		return result, err
+	}
+	feasible = spreadTopology(request, feasible, rejected)
+	result.Scores = strategy.Score(request, feasible)
+	result.Node = feasible[0]
+	for _, node := range feasible[1:] {
+		if result.Scores[node.ObjectMeta.Name] > result.Scores[result.Node.ObjectMeta.Name] {
+			result.Node = node
+		}
+	}
+	return result, nil
+}
+
+// Normalize scales the non-negative scores in proportion to the highest one between 0 and maxScore
+func Normalize(scores map[string]int64, maxScore int64) map[string]int64 {
+	var max int64
+	normalized := make(map[string]int64, len(scores))
+	for _, score := range scores {
+		if score > max {
+			max = score
+		}
+	}
+	for name, score := range scores {
+		if max == 0 || score < 0 {
+			normalized[name] = 0
+			continue
+		}
+		normalized[name] = int64(float64(score) / float64(max) * float64(maxScore))
+	}
+	return normalized
+}
+
+// spreadGroup drops the feasible nodes hosting a volume of the group. With soft anti-affinity they are kept when
+// no other node is feasible.
+func spreadGroup(request *Request, feasible []v1.Node, rejected map[string]string) ([]v1.Node, error) {
+	if request.Group == nil || len(request.Group.Nodes) == 0 {
+		return feasible, nil
+	}
+	spread := []v1.Node{}
+	for _, node := range feasible {
+		if !request.Group.Nodes[node.ObjectMeta.Name] {
+			spread = append(spread, node)
+		}
+	}
+	if len(spread) == 0 && !request.Group.Hard {
+		return feasible, nil
+	}
+	for _, node := range feasible {
+		if request.Group.Nodes[node.ObjectMeta.Name] {
+			rejected[node.ObjectMeta.Name] = "Node hosts a volume of group " + request.Group.Name + " already"
+		}
+	}
+	if len(spread) == 0 {
+		return nil, errors.New("Every node found for label:" + request.Selector + " which can fit the claim hosts a volume of group " + request.Group.Name + " already! " + DescribeRejections(rejected))
+	}
+	return spread, nil
+}
@@ -0,0 +1,204 @@
+package nodeselector
+
+import (
+	"sync"
+	"time"
+
+	"github.com/nokia/dynamic-local-pv-provisioner/pkg/k8sclient"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	"k8s.io/client-go/tools/cache"
+)
+
+type reservation struct {
+	namespace string
+	group     string
+	// colocation is the colocation group of the claim
+	colocation   string
+	storageClass string
+	node         string
+	size         resource.Quantity
+	expires      time.Time
+}
+
+// Reservations tracks the capacity of the placed claims the executor has not provisioned yet.
+// Placements of this replica are reserved at once, the placements of other replicas are learnt from the
+// nodeName annotation of the pending claims, so the claims themselves are the store shared between replicas.
+// A reservation is released when the claim is bound or deleted, or when the timeout expires.
+type Reservations struct {
+	lock         sync.Mutex
+	timeout      time.Duration
+	reservations map[string]reservation
+	// shadow reservations are the placements of a dry run, which are never written on the claims
+	shadow bool
+}
+
+func NewReservations(claims *Claims, timeout time.Duration) *Reservations {
+	return newReservations(claims, timeout, false)
+}
+
+// NewShadowReservations tracks the placements of a dry run apart from the real ones. They are kept until
+// the claim is bound or deleted, or the timeout expires, even though the claim is admitted without placement.
+func NewShadowReservations(claims *Claims, timeout time.Duration) *Reservations {
+	return newReservations(claims, timeout, true)
+}
+
+func newReservations(claims *Claims, timeout time.Duration, shadow bool) *Reservations {
+	reservations := Reservations{timeout: timeout, reservations: make(map[string]reservation), shadow: shadow}
+	claims.informer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc: func(obj interface{}) {
+			reservations.pvcChanged(obj.(*v1.PersistentVolumeClaim))
+		},
+		UpdateFunc: func(oldObj, newObj interface{}) {
+			reservations.pvcChanged(newObj.(*v1.PersistentVolumeClaim))
+		},
+		DeleteFunc: func(obj interface{}) {
+			if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+				obj = tombstone.Obj
+			}
+			if pvc, ok := obj.(*v1.PersistentVolumeClaim); ok {
+				reservations.Release(pvc.ObjectMeta.Namespace, pvc.ObjectMeta.Name)
+			}
+		},
+	})
+	return &reservations
+}
+
+// Reserve books the size of the claim on the node until the claim is bound or the timeout expires
+func (reservations *Reservations) Reserve(pvc *v1.PersistentVolumeClaim, node string) {
+	// Claims created with generateName have no name yet, they are reserved once the informer sees them
+	if pvc.ObjectMeta.Name == "" {
+		return
+	}
+	reservations.lock.Lock()
+	defer reservations.lock.Unlock()
+	reservations.reservations[pvc.ObjectMeta.Namespace+"/"+pvc.ObjectMeta.Name] = reservation{
+		namespace:    pvc.ObjectMeta.Namespace,
+		group:        groupKey(pvc),
+		colocation:   pvc.ObjectMeta.Annotations[ColocationGroupAnnotation],
+		storageClass: storageClassOf(pvc),
+		node:         node,
+		size:         pvc.Spec.Resources.Requests[v1.ResourceStorage],
+		expires:      time.Now().Add(reservations.timeout),
+	}
+}
+
+func (reservations *Reservations) Release(namespace string, name string) {
+	reservations.lock.Lock()
+	defer reservations.lock.Unlock()
+	delete(reservations.reservations, namespace+"/"+name)
+}
+
+// Subtract lowers the lv-capacity of the nodes with the capacity reserved on them
+func (reservations *Reservations) Subtract(nodes []v1.Node) {
+	reserved := reservations.reserved()
+	for i := range nodes {
+		size, ok := reserved[nodes[i].ObjectMeta.Name]
+		nodeCapacity, hasCapacity := nodes[i].Status.Capacity[k8sclient.LvCapacity]
+		if !ok || !hasCapacity {
+			continue
+		}
+		(&nodeCapacity).Sub(size)
+		nodes[i].Status.Capacity[k8sclient.LvCapacity] = nodeCapacity
+	}
+}
+
+func (reservations *Reservations) reserved() map[string]resource.Quantity {
+	reservations.lock.Lock()
+	defer reservations.lock.Unlock()
+	now := time.Now()
+	reserved := make(map[string]resource.Quantity)
+	for key, booking := range reservations.reservations {
+		if now.After(booking.expires) {
+			delete(reservations.reservations, key)
+			continue
+		}
+		size := reserved[booking.node]
+		(&size).Add(booking.size)
+		reserved[booking.node] = size
+	}
+	return reserved
+}
+
+// Locate finds the node reserved for the colocated claims, the informer may not know them yet
+func (reservations *Reservations) Locate(colocation *Colocation, pvc v1.PersistentVolumeClaim) {
+	reservations.lock.Lock()
+	defer reservations.lock.Unlock()
+	now := time.Now()
+	for key, booking := range reservations.reservations {
+		if booking.namespace != pvc.ObjectMeta.Namespace || now.After(booking.expires) {
+			continue
+		}
+		name := key[len(booking.namespace)+1:]
+		if (colocation.Claim != "" && name == colocation.Claim) ||
+			(colocation.Group != "" && name != pvc.ObjectMeta.Name && booking.colocation == colocation.Group) {
+			colocation.Node, colocation.PlacedBy = booking.node, name
+			return
+		}
+	}
+}
+
+// CountTopology counts the reserved claims of the StorageClass per domain, they have no volumes yet
+func (reservations *Reservations) CountTopology(topology *Topology, storageClassName string, group *Group, pvc v1.PersistentVolumeClaim) {
+	reservations.lock.Lock()
+	defer reservations.lock.Unlock()
+	now := time.Now()
+	for key, booking := range reservations.reservations {
+		if key == pvc.ObjectMeta.Namespace+"/"+pvc.ObjectMeta.Name || booking.storageClass != storageClassName || now.After(booking.expires) {
+			continue
+		}
+		if group != nil && (booking.namespace != pvc.ObjectMeta.Namespace || booking.group != group.Name) {
+			continue
+		}
+		topology.CountNode(booking.node)
+	}
+}
+
+// GroupNodes adds the nodes reserved for the other claims of the group, the informer may not know them yet
+func (reservations *Reservations) GroupNodes(group *Group, pvc v1.PersistentVolumeClaim) {
+	reservations.lock.Lock()
+	defer reservations.lock.Unlock()
+	now := time.Now()
+	for key, booking := range reservations.reservations {
+		if key != pvc.ObjectMeta.Namespace+"/"+pvc.ObjectMeta.Name && booking.namespace == pvc.ObjectMeta.Namespace &&
+			booking.group == group.Name && now.Before(booking.expires) {
+			group.Nodes[booking.node] = true
+		}
+	}
+}
+
+func (reservations *Reservations) pvcChanged(pvc *v1.PersistentVolumeClaim) {
+	node, placed := pvc.ObjectMeta.Annotations[k8sclient.NodeName]
+	if pvc.Status.Phase != v1.ClaimPending {
+		reservations.Release(pvc.ObjectMeta.Namespace, pvc.ObjectMeta.Name)
+		return
+	}
+	if !placed {
+		if !reservations.shadow {
+			reservations.Release(pvc.ObjectMeta.Namespace, pvc.ObjectMeta.Name)
+		}
+		return
+	}
+	expires := pvc.ObjectMeta.CreationTimestamp.Add(reservations.timeout)
+	if time.Now().After(expires) {
+		return
+	}
+	reservations.lock.Lock()
+	defer reservations.lock.Unlock()
+	reservations.reservations[pvc.ObjectMeta.Namespace+"/"+pvc.ObjectMeta.Name] = reservation{
+		namespace:    pvc.ObjectMeta.Namespace,
+		group:        groupKey(pvc),
+		colocation:   pvc.ObjectMeta.Annotations[ColocationGroupAnnotation],
+		storageClass: storageClassOf(pvc),
+		node:         node,
+		size:         pvc.Spec.Resources.Requests[v1.ResourceStorage],
+		expires:      expires,
+	}
+}
+
+func storageClassOf(pvc *v1.PersistentVolumeClaim) string {
+	if pvc.Spec.StorageClassName == nil {
+		return ""
+	}
+	return *pvc.Spec.StorageClassName
+}
@@ -0,0 +1,84 @@
+package nodeselector
+
+import (
+	"testing"
+	"time"
+
+	"github.com/nokia/dynamic-local-pv-provisioner/pkg/k8sclient"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func pendingClaim(name string, annotations map[string]string) *v1.PersistentVolumeClaim {
+	return &v1.PersistentVolumeClaim{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace:         "default",
+			Name:              name,
+			Annotations:       annotations,
+			CreationTimestamp: metav1.Now(),
+		},
+		Status: v1.PersistentVolumeClaimStatus{Phase: v1.ClaimPending},
+	}
+}
+
+func TestReservationsLocateColocation(t *testing.T) {
+	tests := []struct {
+		name       string
+		placed     map[string]string
+		colocation Colocation
+		wantNode   string
+	}{
+		{
+			name:       "colocation group",
+			placed:     map[string]string{k8sclient.NodeName: "node-1", ColocationGroupAnnotation: "app"},
+			colocation: Colocation{Group: "app"},
+			wantNode:   "node-1",
+		},
+		{
+			name:       "colocated claim",
+			placed:     map[string]string{k8sclient.NodeName: "node-1"},
+			colocation: Colocation{Claim: "data-0"},
+			wantNode:   "node-1",
+		},
+		{
+			name:       "other colocation group",
+			placed:     map[string]string{k8sclient.NodeName: "node-1", ColocationGroupAnnotation: "other"},
+			colocation: Colocation{Group: "app"},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			reservations := &Reservations{timeout: time.Minute, reservations: make(map[string]reservation)}
+			placed := pendingClaim("data-0", test.placed)
+			// The informer delivers the claim this replica has just reserved
+			reservations.Reserve(placed, "node-1")
+			reservations.pvcChanged(placed)
+			colocation := test.colocation
+			reservations.Locate(&colocation, *pendingClaim("data-1", nil))
+			if colocation.Node != test.wantNode {
+				t.Errorf("Locate found node %q, want %q", colocation.Node, test.wantNode)
+			}
+			if test.wantNode != "" && colocation.PlacedBy != "data-0" {
+				t.Errorf("Locate found the node of %q, want data-0", colocation.PlacedBy)
+			}
+		})
+	}
+}
+
+func TestShadowReservationsOutliveUnplacedClaims(t *testing.T) {
+	for _, shadow := range []bool{false, true} {
+		reservations := &Reservations{timeout: time.Minute, reservations: make(map[string]reservation), shadow: shadow}
+		claim := pendingClaim("data-0", nil)
+		reservations.Reserve(claim, "node-1")
+		// A dry run admits the claim without the nodeName annotation
+		reservations.pvcChanged(claim)
+		if _, reserved := reservations.reserved()["node-1"]; reserved != shadow {
+			t.Errorf("shadow %t: node-1 reserved %t after the unplaced claim is seen, want %t", shadow, reserved, shadow)
+		}
+		claim.Status.Phase = v1.ClaimBound
+		reservations.pvcChanged(claim)
+		if _, reserved := reservations.reserved()["node-1"]; reserved {
+			t.Errorf("shadow %t: node-1 reserved after the claim is bound", shadow)
+		}
+	}
+}
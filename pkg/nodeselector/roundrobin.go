@@ -0,0 +1,56 @@
+package nodeselector
+
+import (
+	"sort"
+	"sync"
+
+	"github.com/nokia/dynamic-local-pv-provisioner/pkg/k8sclient"
+	v1 "k8s.io/api/core/v1"
+)
+
+// roundRobin rotates over the nodes of every selector separately. The rotation continues after the node picked last
+// time in name order, so nodes joining or leaving the selection do not skew it. A peeking request is scored
+// with the node the rotation would pick next, and leaves the rotation where it is.
+type roundRobin struct {
+	lock     sync.Mutex
+	lastPick map[string]string
+}
+
+func init() {
+	Register(k8sclient.RR, func() (NodeSelector, error) { return &roundRobin{lastPick: make(map[string]string)}, nil })
+}
+
+func (strategy *roundRobin) Filter(request *Request, node *v1.Node) error {
+	return nil
+}
+
+func (strategy *roundRobin) Score(request *Request, nodes []v1.Node) map[string]int64 {
+	scores := make(map[string]int64, len(nodes))
+	names := make([]string, 0, len(nodes))
+	for _, node := range nodes {
+		scores[node.ObjectMeta.Name] = 0
+		names = append(names, node.ObjectMeta.Name)
+	}
+	if len(names) == 0 {
+		return scores
+	}
+	sort.Strings(names)
+	strategy.lock.Lock()
+	defer strategy.lock.Unlock()
+	next := names[0]
+	if last, ok := strategy.lastPick[request.Selector]; ok {
+		if i := sort.SearchStrings(names, last); i < len(names) {
+			if names[i] == last {
+				i++
+			}
+			if i < len(names) {
+				next = names[i]
+			}
+		}
+	}
+	if !request.Peek {
+		strategy.lastPick[request.Selector] = next
+	}
+	scores[next] = 1
+	return scores
+}
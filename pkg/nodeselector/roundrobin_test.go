@@ -0,0 +1,22 @@
+package nodeselector
+
+import (
+	"testing"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestRoundRobinPeekKeepsRotation(t *testing.T) {
+	strategy := &roundRobin{lastPick: make(map[string]string)}
+	nodes := []v1.Node{{ObjectMeta: metav1.ObjectMeta{Name: "node-1"}}, {ObjectMeta: metav1.ObjectMeta{Name: "node-2"}}}
+	for i := 0; i < 3; i++ {
+		if scores := strategy.Score(&Request{Selector: "disk=ssd", Peek: true}, nodes); scores["node-1"] != 1 {
+			t.Fatalf("peek %d scores %v, want node-1 next", i, scores)
+		}
+	}
+	strategy.Score(&Request{Selector: "disk=ssd"}, nodes)
+	if scores := strategy.Score(&Request{Selector: "disk=ssd", Peek: true}, nodes); scores["node-2"] != 1 {
+		t.Errorf("peek after a pick of node-1 scores %v, want node-2 next", scores)
+	}
+}
@@ -0,0 +1,110 @@
+package nodeselector
+
+import (
+	"encoding/json"
+	"errors"
+
+	"github.com/nokia/dynamic-local-pv-provisioner/pkg/k8sclient"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+const (
+	// The annotations of the PodNodeSelector and PodTolerationRestriction admission plugins restrict the pods of a namespace
+	namespaceNodeSelectorAnnotation         = "scheduler.alpha.kubernetes.io/node-selector"
+	namespaceDefaultTolerationsAnnotation   = "scheduler.alpha.kubernetes.io/defaultTolerations"
+	namespaceTolerationsWhitelistAnnotation = "scheduler.alpha.kubernetes.io/tolerationsWhitelist"
+)
+
+// Namespace describes the nodes the pods of the namespace of the claim can run on
+type Namespace struct {
+	Name         string
+	NodeSelector labels.Selector
+	// Tolerations the pods of the namespace get by default
+	DefaultTolerations []v1.Toleration
+	// TolerationsWhitelist is nil when the pods may tolerate any taint
+	TolerationsWhitelist []v1.Toleration
+}
+
+func NamespaceOf(namespace *v1.Namespace) (*Namespace, error) {
+	restrictions := Namespace{Name: namespace.ObjectMeta.Name, NodeSelector: labels.Everything()}
+	var err error
+	if nodeSelector, ok := namespace.ObjectMeta.Annotations[namespaceNodeSelectorAnnotation]; ok {
+		restrictions.NodeSelector, err = labels.Parse(nodeSelector)
+		if err != nil {
+			return nil, errors.New("Cannot parse " + namespaceNodeSelectorAnnotation + " of namespace " + namespace.ObjectMeta.Name + ", because: " + err.Error())
+		}
+	}
+	if defaultTolerations, ok := namespace.ObjectMeta.Annotations[namespaceDefaultTolerationsAnnotation]; ok {
+		if err = json.Unmarshal([]byte(defaultTolerations), &restrictions.DefaultTolerations); err != nil {
+			return nil, errors.New("Cannot parse " + namespaceDefaultTolerationsAnnotation + " of namespace " + namespace.ObjectMeta.Name + ", because: " + err.Error())
+		}
+	}
+	if whitelist, ok := namespace.ObjectMeta.Annotations[namespaceTolerationsWhitelistAnnotation]; ok {
+		restrictions.TolerationsWhitelist = []v1.Toleration{}
+		if err = json.Unmarshal([]byte(whitelist), &restrictions.TolerationsWhitelist); err != nil {
+			return nil, errors.New("Cannot parse " + namespaceTolerationsWhitelistAnnotation + " of namespace " + namespace.ObjectMeta.Name + ", because: " + err.Error())
+		}
+	}
+	return &restrictions, nil
+}
+
+// nodeIsSchedulable rejects the nodes in maintenance, without ready local storage or failing the node checks, the cordoned and NotReady nodes, the nodes with taints neither the StorageClass nor the
+// namespace tolerates, and the nodes the pods of the namespace can never run on
+func nodeIsSchedulable(request *Request, node *v1.Node) error {
+	if k8sclient.NodeInMaintenance(node) {
+		return errors.New("Node is in local storage maintenance")
+	}
+	if !k8sclient.NodeConditionIsTrue(node, k8sclient.LocalStorageReady) {
+		return errors.New("Node is not " + string(k8sclient.LocalStorageReady) + ": " + conditionMessage(node, k8sclient.LocalStorageReady))
+	}
+	for _, check := range request.NodeChecks {
+		if err := check(node); err != nil {
+			return err
+		}
+	}
+	if request.SchedulerFiltered {
+		return nil
+	}
+	if node.Spec.Unschedulable {
+		return errors.New("Node is cordoned")
+	}
+	if !k8sclient.NodeConditionIsTrue(node, v1.NodeReady) {
+		return errors.New("Node is NotReady")
+	}
+	namespace := request.Namespace
+	if namespace != nil && !namespace.NodeSelector.Matches(labels.Set(node.ObjectMeta.Labels)) {
+		return errors.New("Node is not selected by the " + namespaceNodeSelectorAnnotation + " of namespace " + namespace.Name)
+	}
+	for i := range node.Spec.Taints {
+		taint := &node.Spec.Taints[i]
+		if taint.Effect != v1.TaintEffectNoSchedule && taint.Effect != v1.TaintEffectNoExecute {
+			continue
+		}
+		if !toleratesTaint(request.Tolerations, taint) && (namespace == nil || !toleratesTaint(namespace.DefaultTolerations, taint)) {
+			return errors.New("Node has untolerated taint " + taint.ToString())
+		}
+		if namespace != nil && namespace.TolerationsWhitelist != nil && !toleratesTaint(namespace.TolerationsWhitelist, taint) {
+			return errors.New("Pods of namespace " + namespace.Name + " cannot tolerate taint " + taint.ToString())
+		}
+	}
+	return nil
+}
+
+func conditionMessage(node *v1.Node, conditionType v1.NodeConditionType) string {
+	for _, condition := range node.Status.Conditions {
+		if condition.Type == conditionType {
+			return condition.Reason + ", " + condition.Message
+		}
+	}
+	return "condition is not reported"
+}
+
+func toleratesTaint(tolerations []v1.Toleration, taint *v1.Taint) bool {
+	for i := range tolerations {
+		if tolerations[i].ToleratesTaint(taint) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,115 @@
+package nodeselector
+
+import (
+	"sort"
+	"strconv"
+
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/selection"
+)
+
+// TopologyParameter is the StorageClass parameter naming the node label the claims are spread over, overriding --topology-spread-key
+const TopologyParameter = "topologySpreadKey"
+
+// Topology spreads the claims evenly over the domains of a node label, like zones or racks
+type Topology struct {
+	Key string
+	// domains maps the node names to the value of their Key label
+	domains map[string]string
+	// hostnames maps the hostname labels to node names
+	hostnames map[string]string
+	// Counts tells how many volumes each domain hosts already
+	Counts map[string]int
+}
+
+// NewTopology maps every node to its domain, nodes without the Key label form the "" domain
+func NewTopology(key string, nodes []v1.Node) *Topology {
+	topology := Topology{Key: key, domains: make(map[string]string), hostnames: make(map[string]string), Counts: make(map[string]int)}
+	for _, node := range nodes {
+		topology.domains[node.ObjectMeta.Name] = node.ObjectMeta.Labels[key]
+		if hostname, ok := node.ObjectMeta.Labels[v1.LabelHostname]; ok {
+			topology.hostnames[hostname] = node.ObjectMeta.Name
+		}
+	}
+	return &topology
+}
+
+// CountVolumes counts the volumes of the StorageClass per domain from their node affinity. With a group only
+// the volumes of the group are counted.
+func (topology *Topology) CountVolumes(volumes *Volumes, claims *Claims, storageClassName string, group *Group) {
+	for _, pv := range volumes.OfStorageClass(storageClassName) {
+		if group != nil && !claims.volumeInGroup(pv, group) {
+			continue
+		}
+		if domain, ok := topology.volumeDomain(pv); ok {
+			topology.Counts[domain]++
+		}
+	}
+}
+
+// CountNode counts a volume on the node which is not provisioned yet
+func (topology *Topology) CountNode(node string) {
+	if domain, ok := topology.domains[node]; ok {
+		topology.Counts[domain]++
+	}
+}
+
+func (topology *Topology) volumeDomain(pv *v1.PersistentVolume) (string, bool) {
+	if pv.Spec.NodeAffinity == nil || pv.Spec.NodeAffinity.Required == nil {
+		return "", false
+	}
+	for _, term := range pv.Spec.NodeAffinity.Required.NodeSelectorTerms {
+		for _, expression := range term.MatchExpressions {
+			if string(expression.Operator) != string(selection.In) || len(expression.Values) == 0 {
+				continue
+			}
+			if expression.Key == topology.Key {
+				return expression.Values[0], true
+			}
+			if expression.Key == v1.LabelHostname {
+				nodeName, ok := topology.hostnames[expression.Values[0]]
+				if !ok {
+					nodeName = expression.Values[0]
+				}
+				domain, ok := topology.domains[nodeName]
+				return domain, ok
+			}
+		}
+	}
+	return "", false
+}
+
+func (claims *Claims) volumeInGroup(pv *v1.PersistentVolume, group *Group) bool {
+	if pv.Spec.ClaimRef == nil {
+		return false
+	}
+	pvc, ok := claims.Placed(pv.Spec.ClaimRef.Namespace)[pv.Spec.ClaimRef.Name]
+	if !ok {
+		return groupFromClaimName(pv.Spec.ClaimRef.Name) == group.Name
+	}
+	return groupKey(pvc) == group.Name
+}
+
+// spreadTopology keeps the feasible nodes of the least populated domains
+func spreadTopology(request *Request, feasible []v1.Node, rejected map[string]string) []v1.Node {
+	topology := request.Topology
+	if topology == nil || len(feasible) == 0 {
+		return feasible
+	}
+	counts := make([]int, 0, len(feasible))
+	for _, node := range feasible {
+		counts = append(counts, topology.Counts[topology.domains[node.ObjectMeta.Name]])
+	}
+	sort.Ints(counts)
+	spread := []v1.Node{}
+	for _, node := range feasible {
+		domain := topology.domains[node.ObjectMeta.Name]
+		if topology.Counts[domain] > counts[0] {
+			rejected[node.ObjectMeta.Name] = "Topology domain " + topology.Key + "=" + domain + " hosts " + strconv.Itoa(topology.Counts[domain]) +
+				" volumes, the least populated one hosts " + strconv.Itoa(counts[0])
+			continue
+		}
+		spread = append(spread, node)
+	}
+	return spread
+}
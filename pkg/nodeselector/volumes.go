@@ -0,0 +1,40 @@
+package nodeselector
+
+import (
+	"github.com/nokia/dynamic-local-pv-provisioner/pkg/k8sclient"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/client-go/tools/cache"
+)
+
+// Volumes keeps the persistent volumes of the cluster up to date from an informer
+type Volumes struct {
+	informer cache.SharedIndexInformer
+}
+
+func NewVolumes() (*Volumes, error) {
+	informer, err := k8sclient.NewPvInformer()
+	if err != nil {
+		return nil, err
+	}
+	return &Volumes{informer: informer}, nil
+}
+
+func (volumes *Volumes) Run(stopCh <-chan struct{}) {
+	volumes.informer.Run(stopCh)
+}
+
+func (volumes *Volumes) HasSynced() bool {
+	return volumes.informer.HasSynced()
+}
+
+// OfStorageClass returns the volumes of the StorageClass
+func (volumes *Volumes) OfStorageClass(storageClassName string) []*v1.PersistentVolume {
+	list := []*v1.PersistentVolume{}
+	for _, obj := range volumes.informer.GetStore().List() {
+		pv, ok := obj.(*v1.PersistentVolume)
+		if ok && pv.Spec.StorageClassName == storageClassName {
+			list = append(list, pv)
+		}
+	}
+	return list
+}
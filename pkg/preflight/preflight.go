@@ -0,0 +1,187 @@
+package preflight
+
+import (
+	"bufio"
+	"errors"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/nokia/dynamic-local-pv-provisioner/pkg/k8sclient"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+)
+
+const (
+	mountInfoPath = "/proc/self/mountinfo"
+
+	ReasonReady            = "PreflightChecksPassed"
+	ReasonNoProjectQuota   = "XfsProjectQuotaMissing"
+	ReasonNoXfsQuota       = "XfsQuotaMissing"
+	ReasonNotWritable      = "FileNotWritable"
+	ReasonNoPropagation    = "MountPropagationMissing"
+	ReasonMountInfoMissing = "MountInfoUnreadable"
+)
+
+// writableFiles are modified by the executor for every volume
+var writableFiles = []string{"/etc/projects", "/etc/projid", "/rootfs/fstab"}
+
+// failure tells which check failed
+type failure struct {
+	reason  string
+	message string
+}
+
+func (f *failure) Error() string {
+	return f.message
+}
+
+// Checker verifies the executor can provision volumes under the storage path of its node
+type Checker struct {
+	nodeName    string
+	storagePath string
+	// OnResult is called with the outcome of every check, when set
+	OnResult func(ready bool)
+}
+
+func NewChecker(nodeName string, storagePath string) *Checker {
+	return &Checker{nodeName: nodeName, storagePath: storagePath}
+}
+
+// Run publishes the result of the checks as the LocalStorageReady condition of the node, repeated every interval
+func (checker *Checker) Run(interval time.Duration, stopCh <-chan struct{}) {
+	wait.Until(func() {
+		condition := checker.Check()
+		if condition.Status != v1.ConditionTrue {
+			log.Println("ERROR: Local storage preflight check failed: " + condition.Message)
+		}
+		if err := k8sclient.SetNodeCondition(checker.nodeName, condition); err != nil {
+			log.Println("ERROR: Cannot set " + string(k8sclient.LocalStorageReady) + " condition of node " + checker.nodeName + ", because: " + err.Error())
+		}
+		if checker.OnResult != nil {
+			checker.OnResult(condition.Status == v1.ConditionTrue)
+		}
+	}, interval, stopCh)
+}
+
+// Check runs every preflight check and returns the LocalStorageReady condition
+func (checker *Checker) Check() v1.NodeCondition {
+	condition := v1.NodeCondition{
+		Type:              k8sclient.LocalStorageReady,
+		Status:            v1.ConditionTrue,
+		Reason:            ReasonReady,
+		Message:           "Local storage under " + checker.storagePath + " is ready",
+		LastHeartbeatTime: metav1.Now(),
+	}
+	if err := checker.run(); err != nil {
+		condition.Status = v1.ConditionFalse
+		condition.Reason = ReasonMountInfoMissing
+		var checkFailure *failure
+		if errors.As(err, &checkFailure) {
+			condition.Reason = checkFailure.reason
+		}
+		condition.Message = err.Error()
+	}
+	return condition
+}
+
+func (checker *Checker) run() error {
+	mount, err := findMount(checker.storagePath)
+	if err != nil {
+		return err
+	}
+	if mount.fsType != "xfs" || !(mount.hasOption("prjquota") || mount.hasOption("pquota")) {
+		return &failure{ReasonNoProjectQuota, checker.storagePath + " is not an XFS filesystem mounted with prjquota, it is " + mount.fsType + " mounted with " + strings.Join(mount.superOptions, ",")}
+	}
+	if !mount.shared {
+		return &failure{ReasonNoPropagation, checker.storagePath + " is not mounted with shared propagation, volumes mounted by the executor would not reach the host"}
+	}
+	if _, err = exec.LookPath("xfs_quota"); err != nil {
+		return &failure{ReasonNoXfsQuota, "xfs_quota is not found, because: " + err.Error()}
+	}
+	for _, path := range writableFiles {
+		file, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0)
+		if err != nil {
+			return &failure{ReasonNotWritable, path + " is not writable, because: " + err.Error()}
+		}
+		file.Close()
+	}
+	return nil
+}
+
+// Reflink tells whether the XFS filesystem of the path shares data blocks between file copies
+func Reflink(path string) bool {
+	output, err := exec.Command("xfs_info", path).CombinedOutput()
+	if err != nil {
+		log.Println("WARNING: Cannot get XFS info of " + path + ", because: " + err.Error())
+		return false
+	}
+	return strings.Contains(string(output), "reflink=1")
+}
+
+type mountPoint struct {
+	path         string
+	fsType       string
+	superOptions []string
+	shared       bool
+}
+
+func (mount mountPoint) hasOption(option string) bool {
+	for _, superOption := range mount.superOptions {
+		if superOption == option {
+			return true
+		}
+	}
+	return false
+}
+
+// findMount returns the mount point the path is on, from the longest matching mount point of the mountinfo
+func findMount(path string) (mountPoint, error) {
+	var found mountPoint
+	path = filepath.Clean(path)
+	file, err := os.Open(mountInfoPath)
+	if err != nil {
+		return found, errors.New("Cannot read " + mountInfoPath + ", because: " + err.Error())
+	}
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		// id parent major:minor root mountpoint options [optional fields...] - fstype source superoptions
+		fields := strings.Fields(scanner.Text())
+		separator := -1
+		for i, field := range fields {
+			if field == "-" {
+				separator = i
+				break
+			}
+		}
+		if len(fields) < 5 || separator < 0 || len(fields) < separator+4 {
+			continue
+		}
+		mountPath := fields[4]
+		if !isUnder(path, mountPath) || len(mountPath) < len(found.path) {
+			continue
+		}
+		found = mountPoint{path: mountPath, fsType: fields[separator+1], superOptions: strings.Split(fields[separator+3], ",")}
+		for _, optional := range fields[6:separator] {
+			if strings.HasPrefix(optional, "shared:") {
+				found.shared = true
+			}
+		}
+	}
+	if err = scanner.Err(); err != nil {
+		return found, errors.New("Cannot read " + mountInfoPath + ", because: " + err.Error())
+	}
+	if found.path == "" {
+		return found, errors.New("No mount point found for " + path)
+	}
+	return found, nil
+}
+
+func isUnder(path string, mountPath string) bool {
+	return mountPath == "/" || path == mountPath || strings.HasPrefix(path, mountPath+"/")
+}
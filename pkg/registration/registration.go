@@ -0,0 +1,193 @@
+package registration
+
+import (
+	"errors"
+
+	"github.com/nokia/dynamic-local-pv-provisioner/pkg/k8sclient"
+	admissionregistrationv1 "k8s.io/api/admissionregistration/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const (
+	MutatingWebhookName         = "dynamic-local-pv-mutator.nokia.k8s.io"
+	ValidatingWebhookName       = "dynamic-local-pv-validator.nokia.k8s.io"
+	UpdateValidatingWebhookName = "dynamic-local-pv-update-validator.nokia.k8s.io"
+	MutatingPath                = "/mutating-pvc"
+	ValidatingPath              = "/validate-pvc"
+)
+
+type Options struct {
+	ConfigName     string
+	ServiceName    string
+	Namespace      string
+	Port           int32
+	CABundle       []byte
+	FailurePolicy  admissionregistrationv1.FailurePolicyType
+	TimeoutSeconds int32
+	// The UPDATE webhook is called by every change of every PVC, including binding and finalizer removal,
+	// so its failure policy and timeout are set apart from the CREATE webhooks
+	UpdateFailurePolicy  admissionregistrationv1.FailurePolicyType
+	UpdateTimeoutSeconds int32
+	NamespaceSelector    *metav1.LabelSelector
+	ObjectSelector       *metav1.LabelSelector
+	// UpdateObjectSelector narrows the UPDATE webhook to the PVCs carrying a label, ObjectSelector applies when nil
+	UpdateObjectSelector *metav1.LabelSelector
+	Validating           bool
+}
+
+// namespaceNameLabel is set on every namespace from Kubernetes 1.21, older clusters call the UPDATE webhook for
+// the PVCs of the webhook namespace too
+const namespaceNameLabel = "kubernetes.io/metadata.name"
+
+func ParseFailurePolicy(policy string) (admissionregistrationv1.FailurePolicyType, error) {
+	switch admissionregistrationv1.FailurePolicyType(policy) {
+	case admissionregistrationv1.Fail, admissionregistrationv1.Ignore:
+		return admissionregistrationv1.FailurePolicyType(policy), nil
+	}
+	return "", errors.New("Unacceptable failure policy " + policy + "! Acceptable values: \"Fail\" or \"Ignore\"")
+}
+
+// Register creates or updates the webhook configurations pointing at the service of this webhook
+func Register(options Options) error {
+	err := k8sclient.ApplyMutatingWebhookConfiguration(mutatingConfiguration(options))
+	if err != nil {
+		return errors.New("Cannot register MutatingWebhookConfiguration " + options.ConfigName + ", because: " + err.Error())
+	}
+	if !options.Validating {
+		return nil
+	}
+	err = k8sclient.ApplyValidatingWebhookConfiguration(validatingConfiguration(options))
+	if err != nil {
+		return errors.New("Cannot register ValidatingWebhookConfiguration " + options.ConfigName + ", because: " + err.Error())
+	}
+	return nil
+}
+
+func Deregister(options Options) error {
+	err := k8sclient.DeleteMutatingWebhookConfiguration(options.ConfigName)
+	if err != nil {
+		return errors.New("Cannot deregister MutatingWebhookConfiguration " + options.ConfigName + ", because: " + err.Error())
+	}
+	if !options.Validating {
+		return nil
+	}
+	err = k8sclient.DeleteValidatingWebhookConfiguration(options.ConfigName)
+	if err != nil {
+		return errors.New("Cannot deregister ValidatingWebhookConfiguration " + options.ConfigName + ", because: " + err.Error())
+	}
+	return nil
+}
+
+func mutatingConfiguration(options Options) *admissionregistrationv1.MutatingWebhookConfiguration {
+	sideEffects := admissionregistrationv1.SideEffectClassNone
+	matchPolicy := admissionregistrationv1.Exact
+	reinvocationPolicy := admissionregistrationv1.NeverReinvocationPolicy
+	failurePolicy := options.FailurePolicy
+	timeoutSeconds := options.TimeoutSeconds
+	return &admissionregistrationv1.MutatingWebhookConfiguration{
+		ObjectMeta: metav1.ObjectMeta{Name: options.ConfigName},
+		Webhooks: []admissionregistrationv1.MutatingWebhook{
+			{
+				Name:                    MutatingWebhookName,
+				AdmissionReviewVersions: []string{"v1", "v1beta1"},
+				ClientConfig:            clientConfig(options, MutatingPath),
+				FailurePolicy:           &failurePolicy,
+				MatchPolicy:             &matchPolicy,
+				NamespaceSelector:       selectorOrEmpty(options.NamespaceSelector),
+				ObjectSelector:          selectorOrEmpty(options.ObjectSelector),
+				ReinvocationPolicy:      &reinvocationPolicy,
+				Rules:                   pvcRules(admissionregistrationv1.Create),
+				SideEffects:             &sideEffects,
+				TimeoutSeconds:          &timeoutSeconds,
+			},
+		},
+	}
+}
+
+func validatingConfiguration(options Options) *admissionregistrationv1.ValidatingWebhookConfiguration {
+	sideEffects := admissionregistrationv1.SideEffectClassNone
+	matchPolicy := admissionregistrationv1.Exact
+	failurePolicy := options.FailurePolicy
+	timeoutSeconds := options.TimeoutSeconds
+	updateFailurePolicy := options.UpdateFailurePolicy
+	updateTimeoutSeconds := options.UpdateTimeoutSeconds
+	updateObjectSelector := options.UpdateObjectSelector
+	if updateObjectSelector == nil {
+		updateObjectSelector = options.ObjectSelector
+	}
+	return &admissionregistrationv1.ValidatingWebhookConfiguration{
+		ObjectMeta: metav1.ObjectMeta{Name: options.ConfigName},
+		Webhooks: []admissionregistrationv1.ValidatingWebhook{
+			{
+				Name:                    ValidatingWebhookName,
+				AdmissionReviewVersions: []string{"v1", "v1beta1"},
+				ClientConfig:            clientConfig(options, ValidatingPath),
+				FailurePolicy:           &failurePolicy,
+				MatchPolicy:             &matchPolicy,
+				NamespaceSelector:       selectorOrEmpty(options.NamespaceSelector),
+				ObjectSelector:          selectorOrEmpty(options.ObjectSelector),
+				Rules:                   pvcRules(admissionregistrationv1.Create),
+				SideEffects:             &sideEffects,
+				TimeoutSeconds:          &timeoutSeconds,
+			},
+			{
+				Name:                    UpdateValidatingWebhookName,
+				AdmissionReviewVersions: []string{"v1", "v1beta1"},
+				ClientConfig:            clientConfig(options, ValidatingPath),
+				FailurePolicy:           &updateFailurePolicy,
+				MatchPolicy:             &matchPolicy,
+				NamespaceSelector:       excludeNamespace(options.NamespaceSelector, options.Namespace),
+				ObjectSelector:          selectorOrEmpty(updateObjectSelector),
+				Rules:                   pvcRules(admissionregistrationv1.Update),
+				SideEffects:             &sideEffects,
+				TimeoutSeconds:          &updateTimeoutSeconds,
+			},
+		},
+	}
+}
+
+func clientConfig(options Options, path string) admissionregistrationv1.WebhookClientConfig {
+	port := options.Port
+	return admissionregistrationv1.WebhookClientConfig{
+		Service: &admissionregistrationv1.ServiceReference{
+			Name:      options.ServiceName,
+			Namespace: options.Namespace,
+			Path:      &path,
+			Port:      &port,
+		},
+		CABundle: options.CABundle,
+	}
+}
+
+func pvcRules(operations ...admissionregistrationv1.OperationType) []admissionregistrationv1.RuleWithOperations {
+	scope := admissionregistrationv1.AllScopes
+	return []admissionregistrationv1.RuleWithOperations{
+		{
+			Operations: operations,
+			Rule: admissionregistrationv1.Rule{
+				APIGroups:   []string{""},
+				APIVersions: []string{"v1"},
+				Resources:   []string{"persistentvolumeclaims"},
+				Scope:       &scope,
+			},
+		},
+	}
+}
+
+func selectorOrEmpty(selector *metav1.LabelSelector) *metav1.LabelSelector {
+	if selector == nil {
+		return &metav1.LabelSelector{}
+	}
+	return selector
+}
+
+// excludeNamespace keeps the PVC updates in the namespace of the webhook from waiting for the webhook itself
+func excludeNamespace(selector *metav1.LabelSelector, namespace string) *metav1.LabelSelector {
+	excluding := selectorOrEmpty(selector).DeepCopy()
+	excluding.MatchExpressions = append(excluding.MatchExpressions, metav1.LabelSelectorRequirement{
+		Key:      namespaceNameLabel,
+		Operator: metav1.LabelSelectorOpNotIn,
+		Values:   []string{namespace},
+	})
+	return excluding
+}
@@ -0,0 +1,128 @@
+package rescheduler
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+
+	"github.com/nokia/dynamic-local-pv-provisioner/pkg/k8sclient"
+	v1 "k8s.io/api/core/v1"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/util/retry"
+)
+
+// Pending is a claim being rescheduled. It is stored before the claim is deleted, so neither a restart nor a
+// change of leader loses the claim between its deletion and its recreation.
+type Pending struct {
+	// UID of the deleted claim, a claim with another UID is its new incarnation
+	UID types.UID `json:"uid"`
+	// FailedNodes are avoided by the new incarnation, even when a controller creates it from a template
+	FailedNodes []string `json:"failedNodes"`
+	// Replacement is created when no controller creates the claim again
+	Replacement *v1.PersistentVolumeClaim `json:"replacement"`
+}
+
+// History keeps the claims being rescheduled in a ConfigMap, keyed by namespace.name
+type History struct {
+	namespace string
+	name      string
+	informer  cache.SharedIndexInformer
+}
+
+func NewHistory(namespace string, name string) (*History, error) {
+	informer, err := k8sclient.NewConfigMapInformer(namespace, name)
+	if err != nil {
+		return nil, err
+	}
+	return &History{namespace: namespace, name: name, informer: informer}, nil
+}
+
+func (history *History) Run(stopCh <-chan struct{}) {
+	history.informer.Run(stopCh)
+}
+
+func (history *History) HasSynced() bool {
+	return history.informer.HasSynced()
+}
+
+// FailedNodes returns the nodes which failed the claims of the name before, the webhook places the new
+// incarnation elsewhere
+func (history *History) FailedNodes(namespace string, name string) []string {
+	pending, ok := history.List()[historyKey(namespace, name)]
+	if !ok {
+		return nil
+	}
+	return pending.FailedNodes
+}
+
+// List returns the claims being rescheduled as the informer knows them
+func (history *History) List() map[string]Pending {
+	list := make(map[string]Pending)
+	obj, exists, err := history.informer.GetStore().GetByKey(history.namespace + "/" + history.name)
+	if err != nil || !exists {
+		return list
+	}
+	for key, value := range obj.(*v1.ConfigMap).Data {
+		pending := Pending{}
+		if err = json.Unmarshal([]byte(value), &pending); err != nil || pending.Replacement == nil {
+			log.Println("ERROR: Ignoring invalid entry " + key + " of ConfigMap " + history.namespace + "/" + history.name)
+			continue
+		}
+		list[key] = pending
+	}
+	return list
+}
+
+// Save stores the claim before it is deleted
+func (history *History) Save(pending Pending) error {
+	value, err := json.Marshal(pending)
+	if err != nil {
+		return err
+	}
+	key := historyKey(pending.Replacement.ObjectMeta.Namespace, pending.Replacement.ObjectMeta.Name)
+	return history.update(func(data map[string]string) {
+		data[key] = string(value)
+	})
+}
+
+// Remove forgets the claim once its new incarnation exists
+func (history *History) Remove(namespace string, name string) error {
+	key := historyKey(namespace, name)
+	return history.update(func(data map[string]string) {
+		delete(data, key)
+	})
+}
+
+func (history *History) update(change func(data map[string]string)) error {
+	// A conflict or a concurrent creation of the ConfigMap is retried on the new revision
+	err := retry.OnError(retry.DefaultRetry, func(err error) bool {
+		return k8serrors.IsConflict(err) || k8serrors.IsAlreadyExists(err)
+	}, func() error {
+		configMap, err := k8sclient.GetConfigMap(history.namespace, history.name)
+		if k8serrors.IsNotFound(err) {
+			configMap = &v1.ConfigMap{ObjectMeta: metav1.ObjectMeta{Namespace: history.namespace, Name: history.name}, Data: make(map[string]string)}
+			change(configMap.Data)
+			return k8sclient.CreateConfigMap(configMap)
+		}
+		if err != nil {
+			return err
+		}
+		if configMap.Data == nil {
+			configMap.Data = make(map[string]string)
+		}
+		change(configMap.Data)
+		return k8sclient.UpdateConfigMap(configMap)
+	})
+	if err != nil {
+		return errors.New("Cannot update ConfigMap " + history.namespace + "/" + history.name + ", because: " + err.Error())
+	}
+	return nil
+}
+
+// Namespaces and names are DNS labels and subdomains, so namespace.name is unique and a valid ConfigMap key
+func historyKey(namespace string, name string) string {
+	return namespace + "." + name
+}
@@ -0,0 +1,183 @@
+package rescheduler
+
+import (
+	"log"
+	"strings"
+	"time"
+
+	"github.com/nokia/dynamic-local-pv-provisioner/pkg/k8sclient"
+	"github.com/nokia/dynamic-local-pv-provisioner/pkg/metrics"
+	"github.com/nokia/dynamic-local-pv-provisioner/pkg/nodeselector"
+	v1 "k8s.io/api/core/v1"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/tools/record"
+)
+
+// OptOutAnnotation set to "false" keeps the claim on its node, even when the node failed it
+const OptOutAnnotation = "nokia.k8s.io/reschedule"
+
+// Rescheduler recreates the claims which stay Pending on a node that failed them, without their placement.
+// The spec.volumeName of a claim cannot be changed, so a claim is only replaced by deleting and creating it again.
+// The claim is saved in the History before it is deleted, and the webhook places every new incarnation of it,
+// the replacement or one a controller creates from its template, avoiding the nodes which failed it.
+// Pods are never deleted, the claim is gone once no pod uses it any more.
+type Rescheduler struct {
+	claims   *nodeselector.Claims
+	nodes    *nodeselector.Nodes
+	history  *History
+	after    time.Duration
+	recorder record.EventRecorder
+}
+
+func NewRescheduler(claims *nodeselector.Claims, nodes *nodeselector.Nodes, history *History, after time.Duration) (*Rescheduler, error) {
+	recorder, err := k8sclient.NewEventRecorder("dynamic-local-pv-rescheduler")
+	if err != nil {
+		return nil, err
+	}
+	return &Rescheduler{claims: claims, nodes: nodes, history: history, after: after, recorder: recorder}, nil
+}
+
+// Run checks the claims every interval until the stop channel is closed
+func (rescheduler *Rescheduler) Run(interval time.Duration, stopCh <-chan struct{}) {
+	wait.Until(rescheduler.resync, interval, stopCh)
+}
+
+func (rescheduler *Rescheduler) resync() {
+	pendings := rescheduler.history.List()
+	for _, pvc := range rescheduler.claims.List() {
+		if _, rescheduling := pendings[historyKey(pvc.ObjectMeta.Namespace, pvc.ObjectMeta.Name)]; rescheduling {
+			continue
+		}
+		if node, reason, ok := rescheduler.failedNode(pvc); ok {
+			rescheduler.reschedule(pvc, node, reason)
+		}
+	}
+	for _, pending := range pendings {
+		rescheduler.recreate(pending)
+	}
+}
+
+// failedNode returns the node of the claim when the node failed it longer than the threshold ago, or the claim is
+// Pending for longer than the threshold and its node is gone
+func (rescheduler *Rescheduler) failedNode(pvc *v1.PersistentVolumeClaim) (string, string, bool) {
+	node, placed := pvc.ObjectMeta.Annotations[k8sclient.NodeName]
+	if !placed || pvc.Status.Phase != v1.ClaimPending || pvc.ObjectMeta.DeletionTimestamp != nil ||
+		pvc.ObjectMeta.Annotations[OptOutAnnotation] == "false" {
+		return "", "", false
+	}
+	if failedAt, failure, ok := k8sclient.ProvisioningFailure(pvc); ok {
+		// Executors older than the failure time in the annotation leave it out
+		if failedAt.IsZero() {
+			failedAt = pvc.ObjectMeta.CreationTimestamp.Time
+		}
+		if time.Since(failedAt) < rescheduler.after {
+			return "", "", false
+		}
+		return node, failure, true
+	}
+	if time.Since(pvc.ObjectMeta.CreationTimestamp.Time) < rescheduler.after {
+		return "", "", false
+	}
+	if nodes, err := rescheduler.nodes.List(""); err == nil && !containsNode(nodes, node) {
+		return node, "node " + node + " is deleted", true
+	}
+	return "", "", false
+}
+
+func (rescheduler *Rescheduler) reschedule(pvc *v1.PersistentVolumeClaim, node string, reason string) {
+	log.Println("INFO: Rescheduling pvc " + key(pvc) + " off node " + node + ", because: " + reason)
+	pending := Pending{UID: pvc.ObjectMeta.UID, FailedNodes: append(failedNodesOf(pvc), node), Replacement: replacement(pvc)}
+	if err := rescheduler.history.Save(pending); err != nil {
+		log.Println("ERROR: Cannot save pvc " + key(pvc) + " for rescheduling, because: " + err.Error())
+		metrics.Reschedules.WithLabelValues("save_failed").Inc()
+		return
+	}
+	rescheduler.recorder.Event(pvc, v1.EventTypeWarning, "Rescheduling", "Claim is recreated without its placement once no pod uses it, because node "+node+" cannot provision it: "+reason)
+	rescheduler.delete(pvc)
+}
+
+func (rescheduler *Rescheduler) delete(pvc *v1.PersistentVolumeClaim) {
+	if err := k8sclient.DeletePvc(pvc); err != nil && !k8serrors.IsNotFound(err) {
+		log.Println("ERROR: Cannot delete pvc " + key(pvc) + " for rescheduling, because: " + err.Error())
+		metrics.Reschedules.WithLabelValues("delete_failed").Inc()
+	}
+}
+
+// recreate drives a saved claim to its new incarnation: the claim is deleted if a previous leader could not,
+// waited for while pods keep it, created again once it is gone, and forgotten when its new incarnation exists
+func (rescheduler *Rescheduler) recreate(pending Pending) {
+	replacement := pending.Replacement
+	pvcKey := replacement.ObjectMeta.Namespace + "/" + replacement.ObjectMeta.Name
+	existing := rescheduler.claims.Get(replacement.ObjectMeta.Namespace, replacement.ObjectMeta.Name)
+	if existing != nil && existing.ObjectMeta.UID == pending.UID {
+		if existing.ObjectMeta.DeletionTimestamp == nil {
+			rescheduler.delete(existing)
+		}
+		return
+	}
+	if existing != nil {
+		if err := rescheduler.history.Remove(replacement.ObjectMeta.Namespace, replacement.ObjectMeta.Name); err != nil {
+			log.Println("ERROR: Cannot forget rescheduled pvc " + pvcKey + ", because: " + err.Error())
+		}
+		return
+	}
+	// The webhook adds the failed nodes of the history to the new claim
+	created := replacement.DeepCopy()
+	err := k8sclient.CreatePvc(created)
+	if err != nil && !k8serrors.IsAlreadyExists(err) {
+		log.Println("ERROR: Cannot recreate pvc " + pvcKey + ", because: " + err.Error())
+		metrics.Reschedules.WithLabelValues("create_failed").Inc()
+		return
+	}
+	if err == nil {
+		log.Println("INFO: Pvc " + pvcKey + " is recreated for rescheduling")
+		metrics.Reschedules.WithLabelValues("success").Inc()
+	}
+}
+
+// replacement copies the claim without its placement
+func replacement(pvc *v1.PersistentVolumeClaim) *v1.PersistentVolumeClaim {
+	annotations := make(map[string]string)
+	for annotation, value := range pvc.ObjectMeta.Annotations {
+		annotations[annotation] = value
+	}
+	for _, annotation := range []string{k8sclient.NodeName, k8sclient.PvDirName, k8sclient.ProvisioningFailed, nodeselector.ExplanationAnnotation,
+		"pv.kubernetes.io/bind-completed", "pv.kubernetes.io/bound-by-controller", "volume.kubernetes.io/selected-node"} {
+		delete(annotations, annotation)
+	}
+	spec := *pvc.Spec.DeepCopy()
+	spec.VolumeName = ""
+	return &v1.PersistentVolumeClaim{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:            pvc.ObjectMeta.Name,
+			Namespace:       pvc.ObjectMeta.Namespace,
+			Labels:          pvc.ObjectMeta.Labels,
+			Annotations:     annotations,
+			OwnerReferences: pvc.ObjectMeta.OwnerReferences,
+		},
+		Spec: spec,
+	}
+}
+
+func failedNodesOf(pvc *v1.PersistentVolumeClaim) []string {
+	previous, ok := pvc.ObjectMeta.Annotations[k8sclient.FailedNodes]
+	if !ok || previous == "" {
+		return []string{}
+	}
+	return strings.Split(previous, ",")
+}
+
+func containsNode(nodes []v1.Node, name string) bool {
+	for _, node := range nodes {
+		if node.ObjectMeta.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+func key(pvc *v1.PersistentVolumeClaim) string {
+	return pvc.ObjectMeta.Namespace + "/" + pvc.ObjectMeta.Name
+}
@@ -0,0 +1,44 @@
+package rescheduler
+
+import (
+	"testing"
+	"time"
+
+	"github.com/nokia/dynamic-local-pv-provisioner/pkg/k8sclient"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestFailedNodeWaitsFromTheFailure(t *testing.T) {
+	created := metav1.NewTime(time.Now().Add(-time.Hour))
+	tests := []struct {
+		name    string
+		failure string
+		want    bool
+	}{
+		{name: "recent failure of an old claim", failure: time.Now().Add(-time.Minute).UTC().Format(time.RFC3339) + " node-1: Not enough free space in storage!"},
+		{name: "old failure", failure: time.Now().Add(-20*time.Minute).UTC().Format(time.RFC3339) + " node-1: Not enough free space in storage!", want: true},
+		{name: "failure without time", failure: "node-1: Not enough free space in storage!", want: true},
+	}
+	rescheduler := &Rescheduler{after: 10 * time.Minute}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			pvc := &v1.PersistentVolumeClaim{
+				ObjectMeta: metav1.ObjectMeta{
+					Namespace:         "default",
+					Name:              "data-0",
+					CreationTimestamp: created,
+					Annotations:       map[string]string{k8sclient.NodeName: "node-1", k8sclient.ProvisioningFailed: test.failure},
+				},
+				Status: v1.PersistentVolumeClaimStatus{Phase: v1.ClaimPending},
+			}
+			node, reason, ok := rescheduler.failedNode(pvc)
+			if ok != test.want {
+				t.Fatalf("failedNode = %t, want %t", ok, test.want)
+			}
+			if ok && (node != "node-1" || reason != "node-1: Not enough free space in storage!") {
+				t.Errorf("failedNode returned node %q and reason %q", node, reason)
+			}
+		})
+	}
+}